@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"runtime/debug"
 	"sync"
 
 	"github.com/kjk/notionapi"
@@ -28,6 +29,12 @@ type Book struct {
 
 	Dir            string // directory name for the book e.g. "go"
 	SoContributors []SoContributor
+	// name of image in covers directory e.g. "Go"
+	Cover string
+	// file in books directory with ids of Stack Overflow contributors
+	SoContributorsFile string
+	// flags from book config, see knownBookFlags
+	Flags []string
 
 	defaultLang string // default programming language for programming examples
 	knownUrls   []string
@@ -36,16 +43,34 @@ type Book struct {
 	tocData []byte
 	// url of combined tocData and app.js
 	AppJSURL string
+	// hash of things shown on every page, used to decide if a page
+	// must be re-generated
+	navHash string
 
 	// cache related
 	cachedOutputFiles       []*cachedOutputFile
 	sha1ToCachedOutputFile  map[string]*cachedOutputFile
 	sha1ToGoPlaygroundCache *Sha1ToGoPlaygroundCache
 	replitCache             *ReplitCache
+	// maps url of an image to the image processed in this build
+	images map[string]*bookImage
+	// maps name of LangRunner to version of its toolchain used to
+	// create cached output
+	toolchainVersions map[string]string
+	// true if cached output is keyed by sha1 of content, as before we
+	// recorded toolchain versions. We migrate it once, in this build
+	migrateLegacyOutput bool
+	// numeric ids of headings from before they were derived from text
+	headingAliases *headingAliases
+	// which cache entries were used, for -gc-cache
+	cacheUsage *cacheUsage
 
 	// for concurrency
 	sem chan bool
 	wg  sync.WaitGroup
+	// protects output cache, replit cache and go playground cache which are updated
+	// when pages are converted to html in parallel
+	mu sync.Mutex
 }
 
 // CacheDir returns a cache dir for this book
@@ -64,11 +89,21 @@ func (b *Book) NotionCacheDir() string {
 	return filepath.Join(b.CacheDir(), "notion")
 }
 
+// ImagesCacheDir returns dir where we cache images from notion pages
+func (b *Book) ImagesCacheDir() string {
+	return filepath.Join(b.CacheDir(), "images")
+}
+
 // ReplitCachePath returns path of the cache file for replits
 func (b *Book) ReplitCachePath() string {
 	return filepath.Join(b.CacheDir(), "replit_cache.txt")
 }
 
+// HeadingAliasesPath returns path of the file with numeric aliases of headings
+func (b *Book) HeadingAliasesPath() string {
+	return filepath.Join(b.CacheDir(), "heading_aliases.txt")
+}
+
 // SourceDir is where source files for a given book are
 func (b *Book) SourceDir() string {
 	return filepath.Join("books", b.Dir)
@@ -116,8 +151,7 @@ func (b *Book) ShareOnTwitterText() string {
 
 // CoverURL returns url to cover image
 func (b *Book) CoverURL() string {
-	coverName := langToCover[b.titleSafe]
-	return fmt.Sprintf("/covers/%s.png", coverName)
+	return fmt.Sprintf("/covers/%s.png", b.Cover)
 }
 
 // CoverFullURL returns a URL for the cover including host
@@ -127,8 +161,7 @@ func (b *Book) CoverFullURL() string {
 
 // CoverTwitterFullURL returns a URL for the cover including host
 func (b *Book) CoverTwitterFullURL() string {
-	coverName := langToCover[b.titleSafe]
-	coverURL := fmt.Sprintf("/covers/twitter/%s.png", coverName)
+	coverURL := fmt.Sprintf("/covers/twitter/%s.png", b.Cover)
 	return urlJoin(siteBaseURL, coverURL)
 }
 
@@ -156,9 +189,6 @@ func (b *Book) GetAllPages() []*Page {
 			continue
 		}
 		seen[page] = true
-		for _, p := range page.Pages {
-			p.Parent = page
-		}
 		pages = append(pages, page.Pages...)
 	}
 	return pages
@@ -195,11 +225,30 @@ func updateBookAppJS(book *Book) {
 	sha1Hex := u.Sha1HexOfBytes(d)
 	name := nameToSha1Name(srcName, sha1Hex)
 	dst := filepath.Join("www", "s", name)
-	err = ioutil.WriteFile(dst, d, 0644)
-	maybePanicIfErr(err)
+	err = writeOutputFileMaybeMust(dst, d)
 	if err != nil {
 		return
 	}
 	book.AppJSURL = "/s/" + name
 	fmt.Printf("Created %s\n", dst)
 }
+
+// runs fn in a goroutine, limiting number of goroutines
+// running at the same time to the size of b.sem. A panic in fn is
+// recorded as an error so that it doesn't kill the build (or -preview)
+func (b *Book) goLimited(fn func()) {
+	sem := b.sem
+	sem <- true
+	b.wg.Add(1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("panic: %v\n%s\n", r, debug.Stack())
+				reportPage(SeverityError, b, nil, "", "panic: %v", r)
+			}
+			<-sem
+			b.wg.Done()
+		}()
+		fn()
+	}()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/essentialbooks/books/pkg/common"
+	"github.com/essentialbooks/books/pkg/kvstore"
+)
+
+/*
+Each book is described by books/${dir}/book.txt in kvstore format e.g.:
+
+Title: Go
+TitleLong: Essential Go
+NotionStartPageID: 2cab1ed2b7a44584b56b0d3ca9b80185
+DefaultLang: go
+Cover: Go
+SoContributors: go_so_contributors.txt
+Flags: disabled
+
+Title and NotionStartPageID are required. Cover is a name of an image
+in covers directory, without .png. SoContributors is a file in books
+directory with ids of Stack Overflow contributors. Flags is a comma
+separated list of knownBookFlags.
+
+To add a book, create books/${dir}/book.txt.
+*/
+
+const (
+	booksDir           = "books"
+	bookConfigFileName = "book.txt"
+
+	// the book is not built
+	bookFlagDisabled = "disabled"
+)
+
+var (
+	knownBookConfigKeys = []string{
+		"Title", "TitleLong", "NotionStartPageID", "DefaultLang", "Cover", "SoContributors", "Flags",
+	}
+	knownBookFlags = []string{bookFlagDisabled}
+)
+
+func isKnownString(a []string, s string) bool {
+	for _, s2 := range a {
+		if s == s2 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFlag returns true if book config has a given flag
+func (b *Book) HasFlag(flag string) bool {
+	return isKnownString(b.Flags, flag)
+}
+
+func loadBookConfig(dir string) (*Book, error) {
+	path := filepath.Join(booksDir, dir, bookConfigFileName)
+	doc, err := kvstore.ParseKVFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range doc {
+		if !isKnownString(knownBookConfigKeys, kv.Key) {
+			return nil, fmt.Errorf("%s: unknown key '%s'", path, kv.Key)
+		}
+	}
+
+	b := &Book{
+		Dir:                dir,
+		Title:              doc.GetSilent("Title", ""),
+		TitleLong:          doc.GetSilent("TitleLong", ""),
+		NotionStartPageID:  normalizeID(doc.GetSilent("NotionStartPageID", "")),
+		defaultLang:        doc.GetSilent("DefaultLang", ""),
+		Cover:              doc.GetSilent("Cover", ""),
+		SoContributorsFile: doc.GetSilent("SoContributors", ""),
+	}
+	for _, flag := range strings.Split(doc.GetSilent("Flags", ""), ",") {
+		flag = strings.TrimSpace(flag)
+		if flag != "" {
+			b.Flags = append(b.Flags, flag)
+		}
+	}
+	if b.TitleLong == "" {
+		b.TitleLong = "Essential " + b.Title
+	}
+	if b.Cover == "" {
+		b.Cover = b.Title
+	}
+	b.titleSafe = common.MakeURLSafe(b.Title)
+
+	err = validateBookConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return b, nil
+}
+
+func validateBookConfig(b *Book) error {
+	if b.Title == "" {
+		return fmt.Errorf("missing Title")
+	}
+	if !isValidNotionID(b.NotionStartPageID) {
+		return fmt.Errorf("'%s' is not a valid NotionStartPageID", b.NotionStartPageID)
+	}
+	if b.defaultLang != "" && findLangRunnerForLang(b.defaultLang) == nil && lexers.Get(b.defaultLang) == nil {
+		return fmt.Errorf("unknown DefaultLang '%s'", b.defaultLang)
+	}
+	coverPath := filepath.Join("covers", b.Cover+".png")
+	if !pathExists(coverPath) {
+		return fmt.Errorf("cover '%s' doesn't exist", coverPath)
+	}
+	if b.SoContributorsFile != "" {
+		path := filepath.Join(booksDir, b.SoContributorsFile)
+		if !pathExists(path) {
+			return fmt.Errorf("SoContributors file '%s' doesn't exist", path)
+		}
+	}
+	for _, flag := range b.Flags {
+		if !isKnownString(knownBookFlags, flag) {
+			return fmt.Errorf("unknown flag '%s', known flags: %s", flag, strings.Join(knownBookFlags, ", "))
+		}
+	}
+	return nil
+}
+
+// loadBooksMust loads configs of all books in books directory. Exits
+// if any config is invalid
+func loadBooksMust() []*Book {
+	fileInfos, err := ioutil.ReadDir(booksDir)
+	panicIfErr(err)
+	var res []*Book
+	var errs []string
+	titles := map[string]string{}
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+		dir := fi.Name()
+		if !pathExists(filepath.Join(booksDir, dir, bookConfigFileName)) {
+			continue
+		}
+		b, err := loadBookConfig(dir)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if otherDir, ok := titles[b.titleSafe]; ok {
+			errs = append(errs, fmt.Sprintf("books '%s' and '%s' have the same url", otherDir, dir))
+			continue
+		}
+		titles[b.titleSafe] = dir
+		if b.HasFlag(bookFlagDisabled) {
+			fmt.Printf("Skipping disabled book '%s'\n", dir)
+			continue
+		}
+		res = append(res, b)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("Invalid book configs:\n%s\n", strings.Join(errs, "\n"))
+		os.Exit(1)
+	}
+	if len(res) == 0 {
+		fmt.Printf("No books in '%s'\n", booksDir)
+		os.Exit(1)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Title < res[j].Title
+	})
+	return res
+}
+
+// selectBooksMust returns books whose dirs are in comma-separated list
+// or all books if the list is empty
+func selectBooksMust(all []*Book, dirs string) []*Book {
+	if strings.TrimSpace(dirs) == "" {
+		return all
+	}
+	var res []*Book
+	for _, dir := range strings.Split(dirs, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		var b *Book
+		var known []string
+		for _, b2 := range all {
+			if b2.Dir == dir {
+				b = b2
+			}
+			known = append(known, b2.Dir)
+		}
+		if b == nil {
+			fmt.Printf("Unknown book '%s', known books: %s\n", dir, strings.Join(known, ", "))
+			os.Exit(1)
+		}
+		if !isBookSelectedIn(res, b) {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func isBookSelectedIn(a []*Book, b *Book) bool {
+	for _, b2 := range a {
+		if b2 == b {
+			return true
+		}
+	}
+	return false
+}
+
+// isBookSelected returns true if we're building the book
+func isBookSelected(b *Book) bool {
+	return isBookSelectedIn(books, b)
+}
+
+// isPartialBuild returns true if we're building only some books
+func isPartialBuild() bool {
+	return len(books) != len(allBooks)
+}
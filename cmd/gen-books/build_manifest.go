@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kjk/u"
+)
+
+/*
+Build manifest records what we generated in www in the previous run so that
+we only re-generate pages whose inputs changed.
+
+For each page we record a hash of inputs:
+- notion json of the page
+- html generated from notion json, so that changes to html generation
+  re-generate pages
+- source files embedded in the page (including their output)
+- template used to render the page
+- navigation i.e. things shown on every page of the book (list of chapters,
+  url of toc javascript etc.)
+
+For every file written to www we record sha1 of its content. Files that were
+generated in the previous run but not in this one are deleted.
+
+generatorVersion should be bumped when a change to the generator changes
+pages in ways not covered by the above (e.g. data given to templates).
+*/
+
+// generatorVersion is recorded in the manifest. Pages from a manifest with a
+// different version are re-generated
+const generatorVersion = 1
+
+var (
+	buildManifestPath = filepath.Join("log", "build_manifest.json")
+
+	// manifest from previous build, read-only
+	prevManifest *BuildManifest
+	// manifest we build during this run
+	currManifest *BuildManifest
+)
+
+// ManifestPage records hashes of inputs and outputs of a single page
+type ManifestPage struct {
+	NotionHash    string
+	BodyHash      string
+	SourcesHash   string
+	TemplatesHash string
+	NavHash       string
+	Outputs       []string
+}
+
+// BuildManifest describes generated files and what they were generated from
+type BuildManifest struct {
+	GeneratorVersion int
+	// maps "${book.Dir}/${page.NotionID}" to a page
+	Pages map[string]*ManifestPage
+	// maps path of a generated file to sha1 of its content
+	Files map[string]string
+	// maps book dir to its lines in _redirects and urls in sitemap.txt
+	// so that we can re-create them when building only some books
+	Redirects   map[string][]string
+	SitemapURLs map[string][]string
+
+	mu sync.Mutex
+}
+
+func newBuildManifest() *BuildManifest {
+	return &BuildManifest{
+		GeneratorVersion: generatorVersion,
+		Pages:            map[string]*ManifestPage{},
+		Files:            map[string]string{},
+		Redirects:        map[string][]string{},
+		SitemapURLs:      map[string][]string{},
+	}
+}
+
+// returns nil if manifest doesn't exist or is not valid
+func loadBuildManifest(path string) *BuildManifest {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var res BuildManifest
+	err = json.Unmarshal(d, &res)
+	if err != nil {
+		fmt.Printf("loadBuildManifest: json.Unmarshal('%s') failed with '%s'\n", path, err)
+		return nil
+	}
+	if res.Pages == nil || res.Files == nil {
+		return nil
+	}
+	if res.Redirects == nil {
+		res.Redirects = map[string][]string{}
+	}
+	if res.SitemapURLs == nil {
+		res.SitemapURLs = map[string][]string{}
+	}
+	return &res
+}
+
+func saveBuildManifest(m *BuildManifest, path string) {
+	d, err := json.MarshalIndent(m, "", "  ")
+	panicIfErr(err)
+	createDirForFileMaybeMust(path)
+	err = ioutil.WriteFile(path, d, 0644)
+	panicIfErr(err)
+}
+
+// if there's no manifest from previous run, we don't know what's in www
+// so we start from scratch
+func initBuildManifest() {
+	prevManifest = loadBuildManifest(buildManifestPath)
+	currManifest = newBuildManifest()
+	if prevManifest == nil {
+		fmt.Printf("No build manifest in '%s', doing full re-build\n", buildManifestPath)
+		// when building only some books, keep what other books generated
+		if isPartialBuild() {
+			fmt.Printf("Warning: _redirects and sitemap.txt will only have selected books\n")
+		} else {
+			os.RemoveAll(destDir)
+		}
+		prevManifest = newBuildManifest()
+	}
+}
+
+// when re-building in the same process, current manifest becomes
+// the previous one
+func startNextBuildManifest() {
+	prevManifest = currManifest
+	currManifest = newBuildManifest()
+}
+
+// deletes files generated in previous build that were not generated in
+// this build and saves the manifest
+func finishBuildManifest() {
+	carryOverUnselectedBooks()
+	var toDelete []string
+	for path := range prevManifest.Files {
+		if _, ok := currManifest.Files[path]; !ok {
+			toDelete = append(toDelete, path)
+		}
+	}
+	sort.Strings(toDelete)
+	for _, path := range toDelete {
+		fmt.Printf("Deleting stale '%s'\n", path)
+		rmFile(path)
+	}
+	saveBuildManifest(currManifest, buildManifestPath)
+	nPages := len(currManifest.Pages)
+	nReused := 0
+	for key, mp := range currManifest.Pages {
+		if prevManifest.Pages[key] == mp {
+			nReused++
+		}
+	}
+	fmt.Printf("Build manifest: %d pages, %d up-to-date, %d re-generated, %d files deleted\n", nPages, nReused, nPages-nReused, len(toDelete))
+}
+
+// returns true if a file in www was generated for one of the books
+// we're building
+func isGeneratedBySelectedBook(path string) bool {
+	for _, b := range books {
+		if strings.HasPrefix(path, filepath.ToSlash(b.destDir())+"/") {
+			return true
+		}
+		if strings.HasPrefix(path, "www/s/app-"+b.titleSafe+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// when building only some books, files and pages of other books (and top-level
+// pages we didn't re-generate) are not stale so we carry them over to
+// the current manifest
+func carryOverUnselectedBooks() {
+	if !isPartialBuild() {
+		return
+	}
+	for path, sha1Hex := range prevManifest.Files {
+		if _, ok := currManifest.Files[path]; ok || isGeneratedBySelectedBook(path) {
+			continue
+		}
+		currManifest.Files[path] = sha1Hex
+	}
+	for key, mp := range prevManifest.Pages {
+		if _, ok := currManifest.Pages[key]; ok {
+			continue
+		}
+		dir := strings.Split(key, "/")[0]
+		if b := findBookFromDir(dir); b != nil && isBookSelected(b) {
+			continue
+		}
+		currManifest.Pages[key] = mp
+	}
+}
+
+// writeOutputFileMaybeMust writes generated file to www unless it already
+// has the same content and records it in the build manifest
+func writeOutputFileMaybeMust(path string, d []byte) error {
+	err := writeOutputFile(path, d)
+	maybePanicIfErr(err)
+	return err
+}
+
+// writeOutputFile is like writeOutputFileMaybeMust but leaves handling of
+// the error to the caller
+func writeOutputFile(path string, d []byte) error {
+	sha1Hex := u.Sha1HexOfBytes(d)
+	path = filepath.ToSlash(path)
+	currManifest.mu.Lock()
+	currManifest.Files[path] = sha1Hex
+	currManifest.mu.Unlock()
+
+	if prevManifest.Files[path] == sha1Hex && pathExists(path) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+func sha1HexOfStrings(a ...string) string {
+	h := sha1.New()
+	for _, s := range a {
+		// separate so that "ab", "c" hashes differently than "a", "bc"
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func manifestPageKey(page *Page) string {
+	return page.Book.Dir + "/" + page.NotionID
+}
+
+// hash of things shown on every page of the book. Must be called after
+// toc javascript was generated
+func calcBookNavHash(book *Book) string {
+	pc := getPageCommon()
+	a := []string{
+		string(pc.Analytics), pc.PathAppJS, pc.PathMainCSS, pc.PathFaviconICO,
+		book.Title, book.TitleLong, book.AppJSURL, book.CoverURL(),
+	}
+	for _, page := range book.GetAllPages() {
+		a = append(a, page.URL(), page.Title)
+		for _, related := range page.Related() {
+			a = append(a, related.URL())
+		}
+	}
+	return sha1HexOfStrings(a...)
+}
+
+func calcNotionHash(page *Page) string {
+	// artificially generated pages (e.g. contributors page) have no notion page
+	if page.NotionPage == nil {
+		return sha1HexOfStrings(string(page.BodyHTML))
+	}
+	path := filepath.Join(page.Book.NotionCacheDir(), page.NotionID+".json")
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		d, err = json.Marshal(page.NotionPage)
+		panicIfErr(err)
+	}
+	// sort and filter of tables are in raw records
+	d = append(d, readNotionRawRecordsFile(page.Book, page.NotionID)...)
+	return u.Sha1HexOfBytes(d)
+}
+
+func calcSourcesHash(page *Page) string {
+	var a []string
+	for _, sf := range page.SourceFiles {
+		a = append(a, sf.Path, string(sf.Data), sf.Output, sf.GitHubURL, sf.PlaygroundURI)
+	}
+	// names of images have hash of their content
+	a = append(a, page.images...)
+	return sha1HexOfStrings(a...)
+}
+
+func calcTemplateHash(tmplName string) string {
+	d, err := ioutil.ReadFile(tmplPath(tmplName))
+	if err != nil {
+		return ""
+	}
+	return u.Sha1HexOfBytes(d)
+}
+
+func newManifestPage(page *Page, tmplName string) *ManifestPage {
+	return &ManifestPage{
+		NotionHash:    calcNotionHash(page),
+		BodyHash:      u.Sha1HexOfBytes([]byte(page.BodyHTML)),
+		SourcesHash:   calcSourcesHash(page),
+		TemplatesHash: calcTemplateHash(tmplName),
+		NavHash:       page.Book.navHash,
+		Outputs:       []string{filepath.ToSlash(page.destFilePath())},
+	}
+}
+
+func (mp *ManifestPage) sameInputs(mp2 *ManifestPage) bool {
+	return mp.NotionHash == mp2.NotionHash &&
+		mp.BodyHash == mp2.BodyHash &&
+		mp.SourcesHash == mp2.SourcesHash &&
+		mp.TemplatesHash == mp2.TemplatesHash &&
+		mp.NavHash == mp2.NavHash
+}
+
+// isPageUpToDate returns true if page was generated in previous build
+// from the same inputs and its outputs still exist. In that case it's
+// carried over to the current manifest
+func isPageUpToDate(page *Page, mp *ManifestPage) bool {
+	key := manifestPageKey(page)
+	if prevManifest.GeneratorVersion != generatorVersion {
+		return false
+	}
+	prev := prevManifest.Pages[key]
+	if prev == nil || !prev.sameInputs(mp) {
+		return false
+	}
+	for _, path := range prev.Outputs {
+		if _, ok := prevManifest.Files[path]; !ok || !pathExists(path) {
+			return false
+		}
+	}
+	currManifest.mu.Lock()
+	currManifest.Pages[key] = prev
+	for _, path := range prev.Outputs {
+		currManifest.Files[path] = prevManifest.Files[path]
+	}
+	currManifest.mu.Unlock()
+	return true
+}
+
+func recordManifestPage(page *Page, mp *ManifestPage) {
+	currManifest.mu.Lock()
+	currManifest.Pages[manifestPageKey(page)] = mp
+	currManifest.mu.Unlock()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/essentialbooks/books/pkg/kvstore"
+)
+
+/*
+Caches of outputs, go playground ids and replits are append-only. When code
+changes or is removed from a book, old entries stay in the cache forever.
+
+With -gc-cache we do a regular build during which we record which cache
+entries were used. After the build we remove entries that were not used
+and re-write the cache files compactly.
+*/
+
+// cacheUsage records which cache entries were used during the build
+type cacheUsage struct {
+	// keys of cached output (see outputCacheKey)
+	outputKeys map[string]bool
+	// sha1 of files submitted to go playground
+	playgroundSha1s map[string]bool
+	// urls of replits
+	replitURLs map[string]bool
+}
+
+func newCacheUsage() *cacheUsage {
+	return &cacheUsage{
+		outputKeys:      map[string]bool{},
+		playgroundSha1s: map[string]bool{},
+		replitURLs:      map[string]bool{},
+	}
+}
+
+// returns size of a file or 0 if it doesn't exist
+func fileSizeOrZero(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func printGCStats(path string, sizeBefore int64, nRemoved int) int64 {
+	sizeAfter := fileSizeOrZero(path)
+	fmt.Printf("gc-cache: '%s' %d => %d bytes, removed %d entries\n", path, sizeBefore, sizeAfter, nRemoved)
+	return sizeBefore - sizeAfter
+}
+
+// re-writes cached_output_${no}.txt files with only used outputs
+func gcCachedOutput(b *Book) int64 {
+	var sizeBefore int64
+	var kept kvstore.Doc
+	var oldPaths []string
+	nRemoved := 0
+	for _, cof := range b.cachedOutputFiles {
+		sizeBefore += fileSizeOrZero(cof.path)
+		oldPaths = append(oldPaths, cof.path)
+		for _, kv := range cof.doc {
+			if b.cacheUsage.outputKeys[kv.Key] {
+				kept = append(kept, kv)
+			} else {
+				nRemoved++
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Key < kept[j].Key
+	})
+
+	b.cachedOutputFiles = nil
+	for _, kv := range kept {
+		cof := getCurrentOutputCacheFile(b)
+		cof.doc = append(cof.doc, kv)
+	}
+
+	// an entry can move to a different file so we write all compacted
+	// files before replacing any of the old files. If that fails,
+	// the cache is unchanged
+	var tmpPaths []string
+	for _, cof := range b.cachedOutputFiles {
+		tmpPath := cof.path + ".tmp"
+		err := ioutil.WriteFile(tmpPath, serializeCachedOutputDoc(cof.doc), 0644)
+		if err != nil {
+			for _, path := range append(tmpPaths, tmpPath) {
+				os.Remove(path)
+			}
+			panicIfErr(err)
+		}
+		tmpPaths = append(tmpPaths, tmpPath)
+	}
+	newPaths := map[string]bool{}
+	var sizeAfter int64
+	for i, cof := range b.cachedOutputFiles {
+		err := os.Rename(tmpPaths[i], cof.path)
+		panicIfErr(err)
+		newPaths[cof.path] = true
+		sizeAfter += fileSizeOrZero(cof.path)
+	}
+	// old files with numbers higher than compacted files
+	for _, path := range oldPaths {
+		if !newPaths[path] {
+			rmFile(path)
+		}
+	}
+	reloadCachedOutputFilesMust(b)
+	fmt.Printf("gc-cache: '%s' %d => %d bytes, removed %d entries\n", b.OutputCacheDir(), sizeBefore, sizeAfter, nRemoved)
+	return sizeBefore - sizeAfter
+}
+
+func gcGoPlaygroundCache(b *Book) int64 {
+	c := b.sha1ToGoPlaygroundCache
+	sizeBefore := fileSizeOrZero(c.cachePath)
+	var sha1s []string
+	nRemoved := 0
+	for sha1 := range c.sha1ToID {
+		if b.cacheUsage.playgroundSha1s[sha1] {
+			sha1s = append(sha1s, sha1)
+		} else {
+			delete(c.sha1ToID, sha1)
+			nRemoved++
+		}
+	}
+	sort.Strings(sha1s)
+	var lines []string
+	for _, sha1 := range sha1s {
+		lines = append(lines, fmt.Sprintf("%s %s\n", sha1, c.sha1ToID[sha1]))
+	}
+	err := writeFileAtomic(c.cachePath, []byte(strings.Join(lines, "")))
+	panicIfErr(err)
+	return printGCStats(c.cachePath, sizeBefore, nRemoved)
+}
+
+// replit cache also has old versions of replits that were re-downloaded
+func gcReplitCache(b *Book) int64 {
+	c := b.replitCache
+	sizeBefore := fileSizeOrZero(c.path)
+	var urls []string
+	nRemoved := 0
+	for uri := range c.replits {
+		if b.cacheUsage.replitURLs[uri] {
+			urls = append(urls, uri)
+		} else {
+			delete(c.replits, uri)
+			nRemoved++
+		}
+	}
+	sort.Strings(urls)
+	var d []byte
+	for _, uri := range urls {
+		rec := replitToRecord(c.replits[uri])
+		d = append(d, rec.Marshal()...)
+	}
+	err := c.Close()
+	panicIfErr(err)
+	err = writeFileAtomic(c.path, d)
+	panicIfErr(err)
+	// re-open for appending
+	b.replitCache, err = LoadReplitCache(c.path)
+	panicIfErr(err)
+	return printGCStats(c.path, sizeBefore, nRemoved)
+}
+
+// writes to a temporary file and renames so that we don't end up with
+// a partially written cache
+func writeFileAtomic(path string, d []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// gcCaches removes cache entries not used in the build that just happened.
+// Pages that failed might not have used their cache entries so we only
+// do it after a build without errors
+func gcCaches() {
+	if diagnosticsHadErrors || diagnosticsFailedBuild {
+		fmt.Printf("gc-cache: skipped because the build had errors, fix them and re-run with -gc-cache\n")
+		return
+	}
+	var total int64
+	for _, b := range books {
+		total += gcCachedOutput(b)
+		total += gcGoPlaygroundCache(b)
+		total += gcReplitCache(b)
+	}
+	fmt.Printf("gc-cache: reclaimed %d bytes\n", total)
+}
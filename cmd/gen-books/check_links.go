@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+-check-links checks links in the generated website. For every .html file
+in www we check that:
+- internal links (href and src) point to a file in www, directly or via
+  a rule in _redirects
+- #anchor in a link is an id in the target file
+We also check that targets of rules in _redirects exist.
+
+With -check-external-links we also send HEAD request to every external
+link. Results are cached in log/external_links.json so that we don't
+check the same link on every build.
+
+Broken links are recorded as diagnostics of the page with the link.
+*/
+
+const (
+	externalLinksCachePath = "log/external_links.json"
+	// how long we trust a successful check of an external link
+	externalLinkCacheDuration = 7 * 24 * time.Hour
+	externalLinkWorkers       = 8
+)
+
+var (
+	rxTag = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+	// attribute can be quoted or, in minified html, unquoted
+	rxTagAttr = regexp.MustCompile(`\s(href|src|id)=(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// htmlFileLinks are links and ids in a single html file
+type htmlFileLinks struct {
+	links []string
+	ids   map[string]bool
+}
+
+// redirectRule is a line in _redirects e.g.
+// /essential/go/${id}* /essential/go/${id}-${title} 302
+type redirectRule struct {
+	from   string
+	to     string
+	status string
+}
+
+// externalLinkStatus is a cached result of checking an external link
+type externalLinkStatus struct {
+	Status    int
+	Err       string `json:",omitempty"`
+	CheckedOn time.Time
+}
+
+func (s *externalLinkStatus) isOk() bool {
+	return s.Err == "" && s.Status >= 200 && s.Status < 400
+}
+
+// linkChecker checks links in website generated in wwwDir
+type linkChecker struct {
+	wwwDir string
+	// paths of all files in www, relative to www, with '/' separator
+	files map[string]bool
+	// links and ids of html files, keyed like files
+	htmlFiles map[string]*htmlFileLinks
+	redirects []*redirectRule
+	// maps path of generated html file of a page to the page
+	pathToPage map[string]*Page
+
+	httpClient *http.Client
+	// external link => pages that link to it
+	externalLinks map[string][]string
+	externalCache map[string]*externalLinkStatus
+}
+
+func newLinkChecker(wwwDir string) *linkChecker {
+	return &linkChecker{
+		wwwDir:        wwwDir,
+		files:         map[string]bool{},
+		htmlFiles:     map[string]*htmlFileLinks{},
+		pathToPage:    map[string]*Page{},
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+		externalLinks: map[string][]string{},
+		externalCache: map[string]*externalLinkStatus{},
+	}
+}
+
+func parseHTMLFileLinks(d []byte) *htmlFileLinks {
+	res := &htmlFileLinks{
+		ids: map[string]bool{},
+	}
+	for _, tag := range rxTag.FindAll(d, -1) {
+		for _, m := range rxTagAttr.FindAllSubmatch(tag, -1) {
+			v := string(m[2]) + string(m[3]) + string(m[4])
+			v = strings.Replace(v, "&amp;", "&", -1)
+			if string(m[1]) == "id" {
+				res.ids[v] = true
+			} else {
+				res.links = append(res.links, v)
+			}
+		}
+	}
+	return res
+}
+
+func (c *linkChecker) loadFiles() error {
+	paths, err := getFilesRecur(c.wwwDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		rel, err := filepath.Rel(c.wwwDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		c.files[rel] = true
+		if filepath.Ext(rel) != ".html" {
+			continue
+		}
+		d, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		c.htmlFiles[rel] = parseHTMLFileLinks(d)
+	}
+	return nil
+}
+
+func (c *linkChecker) loadRedirects() error {
+	d, err := ioutil.ReadFile(filepath.Join(c.wwwDir, "_redirects"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+		r := &redirectRule{
+			from:   parts[0],
+			to:     parts[1],
+			status: "301",
+		}
+		if len(parts) > 2 {
+			r.status = parts[2]
+		}
+		c.redirects = append(c.redirects, r)
+	}
+	return scanner.Err()
+}
+
+// returns target of the first redirect rule matching url path
+func (c *linkChecker) findRedirect(urlPath string) *redirectRule {
+	for _, r := range c.redirects {
+		if strings.HasSuffix(r.from, "*") {
+			if strings.HasPrefix(urlPath, strings.TrimSuffix(r.from, "*")) {
+				return r
+			}
+			continue
+		}
+		if urlPath == r.from {
+			return r
+		}
+	}
+	return nil
+}
+
+// returns file in www served for url path, like netlify does, or empty
+// string if there's no such file
+func (c *linkChecker) findFile(urlPath string) string {
+	p := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if strings.HasSuffix(urlPath, "/") || p == "" {
+		p = path.Join(p, "index.html")
+		if c.files[p] {
+			return p
+		}
+		return ""
+	}
+	for _, candidate := range []string{p, p + ".html", p + "/index.html"} {
+		if c.files[candidate] {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// resolves url path to a file, following redirects. Returns error if
+// url is broken
+func (c *linkChecker) resolve(urlPath string) (string, error) {
+	if file := c.findFile(urlPath); file != "" {
+		return file, nil
+	}
+	r := c.findRedirect(urlPath)
+	if r == nil || r.status == "404" || strings.Contains(r.to, ":splat") {
+		return "", fmt.Errorf("'%s' doesn't exist", urlPath)
+	}
+	if isExternalLink(r.to) {
+		return "", nil
+	}
+	to, err := url.Parse(r.to)
+	if err != nil {
+		return "", err
+	}
+	if file := c.findFile(to.Path); file != "" {
+		return file, nil
+	}
+	return "", fmt.Errorf("'%s' redirects to '%s' which doesn't exist", urlPath, r.to)
+}
+
+func isExternalLink(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "//")
+}
+
+// returns a problem with a link in html file src or empty string if
+// the link is ok
+func (c *linkChecker) checkLink(src string, link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return fmt.Sprintf("invalid link '%s'", link)
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+	file := src
+	if u.Path != "" {
+		urlPath := u.Path
+		if !strings.HasPrefix(urlPath, "/") {
+			urlPath = path.Join(path.Dir("/"+src), urlPath)
+			if strings.HasSuffix(u.Path, "/") {
+				urlPath += "/"
+			}
+		}
+		file, err = c.resolve(urlPath)
+		if err != nil {
+			return fmt.Sprintf("broken link '%s': %s", link, err)
+		}
+	}
+	if u.Fragment == "" || file == "" {
+		return ""
+	}
+	target := c.htmlFiles[file]
+	if target == nil || !target.ids[u.Fragment] {
+		return fmt.Sprintf("broken link '%s': no anchor '#%s' in '%s'", link, u.Fragment, file)
+	}
+	return ""
+}
+
+func (c *linkChecker) reportFile(sev Severity, src string, format string, args ...interface{}) {
+	page := c.pathToPage[src]
+	if page != nil {
+		reportPage(sev, page.Book, page, "", format, args...)
+		return
+	}
+	reportPage(sev, nil, nil, "", "%s: %s", src, fmt.Sprintf(format, args...))
+}
+
+func (c *linkChecker) checkInternalLinks() int {
+	var srcs []string
+	for src := range c.htmlFiles {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+	nBroken := 0
+	for _, src := range srcs {
+		seen := map[string]bool{}
+		for _, link := range c.htmlFiles[src].links {
+			if seen[link] {
+				continue
+			}
+			seen[link] = true
+			if isExternalLink(link) {
+				c.externalLinks[link] = append(c.externalLinks[link], src)
+				continue
+			}
+			if problem := c.checkLink(src, link); problem != "" {
+				c.reportFile(SeverityError, src, "%s", problem)
+				nBroken++
+			}
+		}
+	}
+	return nBroken
+}
+
+func (c *linkChecker) checkRedirects() int {
+	nBroken := 0
+	for _, r := range c.redirects {
+		if isExternalLink(r.to) || strings.Contains(r.to, ":splat") {
+			continue
+		}
+		to, err := url.Parse(r.to)
+		if err == nil && c.findFile(to.Path) != "" {
+			continue
+		}
+		reportPage(SeverityError, nil, nil, "", "_redirects: '%s' redirects to '%s' which doesn't exist", r.from, r.to)
+		nBroken++
+	}
+	return nBroken
+}
+
+func (c *linkChecker) loadExternalCache() {
+	d, err := ioutil.ReadFile(externalLinksCachePath)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(d, &c.externalCache)
+	if err != nil {
+		fmt.Printf("json.Unmarshal('%s') failed with '%s'\n", externalLinksCachePath, err)
+		c.externalCache = map[string]*externalLinkStatus{}
+	}
+}
+
+func (c *linkChecker) saveExternalCache() {
+	d, err := json.MarshalIndent(c.externalCache, "", "  ")
+	panicIfErr(err)
+	err = writeFileAtomic(externalLinksCachePath, d)
+	if err != nil {
+		fmt.Printf("Saving '%s' failed with '%s'\n", externalLinksCachePath, err)
+	}
+}
+
+func (c *linkChecker) checkExternalLink(uri string) *externalLinkStatus {
+	if strings.HasPrefix(uri, "//") {
+		uri = "https:" + uri
+	}
+	res := &externalLinkStatus{
+		CheckedOn: time.Now().UTC(),
+	}
+	rsp, err := c.httpClient.Head(uri)
+	// some servers don't support HEAD
+	if err == nil && rsp.StatusCode == http.StatusMethodNotAllowed {
+		rsp.Body.Close()
+		rsp, err = c.httpClient.Get(uri)
+	}
+	if err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	rsp.Body.Close()
+	res.Status = rsp.StatusCode
+	return res
+}
+
+func (c *linkChecker) checkExternalLinks() int {
+	c.loadExternalCache()
+	var toCheck []string
+	for link := range c.externalLinks {
+		s := c.externalCache[link]
+		if s != nil && s.isOk() && time.Since(s.CheckedOn) < externalLinkCacheDuration {
+			continue
+		}
+		toCheck = append(toCheck, link)
+	}
+	fmt.Printf("Checking %d external links, %d in cache\n", len(toCheck), len(c.externalLinks)-len(toCheck))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan bool, externalLinkWorkers)
+	for _, link := range toCheck {
+		wg.Add(1)
+		sem <- true
+		go func(link string) {
+			s := c.checkExternalLink(link)
+			mu.Lock()
+			c.externalCache[link] = s
+			mu.Unlock()
+			<-sem
+			wg.Done()
+		}(link)
+	}
+	wg.Wait()
+	c.saveExternalCache()
+
+	var links []string
+	for link := range c.externalLinks {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	nBroken := 0
+	for _, link := range links {
+		s := c.externalCache[link]
+		if s.isOk() {
+			continue
+		}
+		problem := fmt.Sprintf("http status %d", s.Status)
+		if s.Err != "" {
+			problem = s.Err
+		}
+		// external sites can be temporarily down so it's only a warning
+		for _, src := range c.externalLinks[link] {
+			c.reportFile(SeverityWarning, src, "broken external link '%s': %s", link, problem)
+		}
+		nBroken++
+	}
+	return nBroken
+}
+
+// checkLinks checks links in generated website and records broken links
+// as diagnostics
+func checkLinks() {
+	timeStart := time.Now()
+	c := newLinkChecker("www")
+	for _, b := range allBooks {
+		for _, page := range b.GetAllPages() {
+			if page.Book == nil {
+				continue
+			}
+			rel, err := filepath.Rel(c.wwwDir, page.destFilePath())
+			if err == nil {
+				c.pathToPage[filepath.ToSlash(rel)] = page
+			}
+		}
+	}
+	err := c.loadFiles()
+	if err == nil {
+		err = c.loadRedirects()
+	}
+	if err != nil {
+		addError(fmt.Errorf("checking links failed with '%s'", err))
+		return
+	}
+	nBroken := c.checkInternalLinks()
+	nBroken += c.checkRedirects()
+	nExternal := len(c.externalLinks)
+	if flgCheckExternalLinks {
+		nBroken += c.checkExternalLinks()
+	}
+	fmt.Printf("Checked links in %d html files (%d external links) in %s, %d broken\n", len(c.htmlFiles), nExternal, time.Since(timeStart), nBroken)
+}
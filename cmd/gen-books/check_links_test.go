@@ -0,0 +1,257 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// creates a website in a temporary directory and a link checker for it
+func newTestLinkChecker(t *testing.T, files map[string]string) *linkChecker {
+	dir, err := ioutil.TempDir("", "check_links_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	for name, s := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		createDirForFileMaybeMust(path)
+		if err = ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newLinkChecker(dir)
+	if err = c.loadFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.loadRedirects(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testWebsite() map[string]string {
+	return map[string]string{
+		"index.html":                  `<a href="/essential/go/">Go</a>`,
+		"about.html":                  `<h1 id=about>About</h1>`,
+		"404.html":                    `Not found`,
+		"essential/go/index.html":     `<a href="abc-intro">Intro</a>`,
+		"essential/go/abc-intro.html": `<h1 id="intro">Intro</h1><a href='other#sec'>`,
+		"essential/go/other.html":     `<h2 id="sec">Section</h2>`,
+		"essential/go/img/logo.png":   "png",
+		"_redirects": `
+# comment
+/essential/go/abc* /essential/go/abc-intro 302
+/old/* /new/:splat 301
+/gone /404.html 404
+/ext https://example.com 302
+/bad /nowhere 302
+`,
+	}
+}
+
+func TestLinkCheckerFindFile(t *testing.T) {
+	c := newTestLinkChecker(t, testWebsite())
+	tests := []struct {
+		urlPath string
+		exp     string
+	}{
+		{"/", "index.html"},
+		{"", "index.html"},
+		{"/about", "about.html"},
+		{"/about.html", "about.html"},
+		{"/essential/go/", "essential/go/index.html"},
+		{"/essential/go", "essential/go/index.html"},
+		{"/essential/go/../go/other", "essential/go/other.html"},
+		{"/essential/go/img/logo.png", "essential/go/img/logo.png"},
+		{"/about/", ""},
+		{"/missing", ""},
+	}
+	for _, test := range tests {
+		got := c.findFile(test.urlPath)
+		if got != test.exp {
+			t.Errorf("findFile(%q) = %q, expected %q", test.urlPath, got, test.exp)
+		}
+	}
+}
+
+func TestLinkCheckerResolve(t *testing.T) {
+	c := newTestLinkChecker(t, testWebsite())
+	tests := []struct {
+		urlPath string
+		exp     string
+		isErr   bool
+	}{
+		{"/about", "about.html", false},
+		// files take precedence over redirects
+		{"/essential/go/abc-intro", "essential/go/abc-intro.html", false},
+		{"/essential/go/abc", "essential/go/abc-intro.html", false},
+		{"/essential/go/abcdef", "essential/go/abc-intro.html", false},
+		// we can't tell where :splat redirects go
+		{"/old/foo", "", true},
+		{"/gone", "", true},
+		// external redirects are not checked
+		{"/ext", "", false},
+		{"/bad", "", true},
+		{"/missing", "", true},
+	}
+	for _, test := range tests {
+		got, err := c.resolve(test.urlPath)
+		if got != test.exp || (err != nil) != test.isErr {
+			t.Errorf("resolve(%q) = %q, %v, expected %q, error: %v", test.urlPath, got, err, test.exp, test.isErr)
+		}
+	}
+}
+
+func TestLinkCheckerCheckLink(t *testing.T) {
+	c := newTestLinkChecker(t, testWebsite())
+	src := "essential/go/abc-intro.html"
+	tests := []struct {
+		link string
+		// substring of the problem, empty if the link is ok
+		exp string
+	}{
+		{"other", ""},
+		{"other.html", ""},
+		{"other#sec", ""},
+		{"./other#sec", ""},
+		{"../../about.html#about", ""},
+		{"/essential/go/", ""},
+		{"/essential/go/abc#intro", ""},
+		{"#intro", ""},
+		{"img/logo.png", ""},
+		{"https://example.com/missing", ""},
+		{"//example.com/missing", ""},
+		{"other#nope", "no anchor '#nope' in 'essential/go/other.html'"},
+		{"#nope", "no anchor '#nope' in 'essential/go/abc-intro.html'"},
+		{"/essential/go/abc#nope", "no anchor '#nope'"},
+		{"missing.html", "broken link 'missing.html'"},
+		{"../about.html", "broken link '../about.html'"},
+		{"/bad", "redirects to '/nowhere'"},
+		{"%zz", "invalid link"},
+	}
+	for _, test := range tests {
+		got := c.checkLink(src, test.link)
+		if test.exp == "" && got != "" {
+			t.Errorf("checkLink(%q) = %q, expected no problem", test.link, got)
+		}
+		if test.exp != "" && !strings.Contains(got, test.exp) {
+			t.Errorf("checkLink(%q) = %q, expected problem with %q", test.link, got, test.exp)
+		}
+	}
+}
+
+func TestCheckInternalLinks(t *testing.T) {
+	files := testWebsite()
+	files["essential/go/other.html"] += `<a href="abc-intro#missing">`
+	c := newTestLinkChecker(t, files)
+	defer clearDiagnostics()
+	if n := c.checkInternalLinks(); n != 1 {
+		t.Errorf("got %d broken links, expected 1", n)
+	}
+	// _redirects: /bad redirects to a missing file
+	if n := c.checkRedirects(); n != 1 {
+		t.Errorf("got %d broken redirects, expected 1", n)
+	}
+}
+
+// counts requests to the test server by method and path
+type requestCounter struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (rc *requestCounter) add(r *http.Request) {
+	rc.mu.Lock()
+	rc.n[r.Method+" "+r.URL.Path]++
+	rc.mu.Unlock()
+}
+
+func (rc *requestCounter) get(s string) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.n[s]
+}
+
+func clearDiagnostics() {
+	muDiagnostics.Lock()
+	diagnostics = nil
+	muDiagnostics.Unlock()
+}
+
+func TestCheckExternalLinks(t *testing.T) {
+	rc := &requestCounter{n: map[string]int{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc.add(r)
+		switch r.URL.Path {
+		case "/ok":
+		case "/no-head":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// external links cache is in log directory
+	dir, err := ioutil.TempDir("", "check_links_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}()
+	createDirMust("log")
+	defer clearDiagnostics()
+
+	check := func() int {
+		c := newLinkChecker("www")
+		for _, s := range []string{"/ok", "/no-head", "/missing"} {
+			c.externalLinks[srv.URL+s] = []string{"index.html"}
+		}
+		return c.checkExternalLinks()
+	}
+
+	if n := check(); n != 1 {
+		t.Fatalf("got %d broken external links, expected 1", n)
+	}
+	if rc.get("HEAD /no-head") != 1 || rc.get("GET /no-head") != 1 {
+		t.Errorf("expected GET after HEAD failed with 405, got requests %v", rc.n)
+	}
+	if !pathExists(externalLinksCachePath) {
+		t.Fatalf("'%s' not saved", externalLinksCachePath)
+	}
+
+	// good links come from the cache, broken links are checked again
+	if n := check(); n != 1 {
+		t.Fatalf("got %d broken external links, expected 1", n)
+	}
+	exp := map[string]int{
+		"HEAD /ok":      1,
+		"HEAD /no-head": 1,
+		"GET /no-head":  1,
+		"HEAD /missing": 2,
+	}
+	for s, n := range exp {
+		if got := rc.get(s); got != n {
+			t.Errorf("got %d requests '%s', expected %d", got, s, n)
+		}
+	}
+}
@@ -93,6 +93,9 @@ func getLangFromFileExt(fileName string) string {
 	case ".yml":
 		return "yaml"
 	}
+	if r := findLangRunnerForFile(fileName); r != nil {
+		return r.Lexer
+	}
 	fmt.Printf("Couldn't deduce language from file name '%s'\n", fileName)
 	// TODO: more languages
 	return ""
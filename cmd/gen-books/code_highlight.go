@@ -86,6 +86,9 @@ func htmlHighlight(w io.Writer, source, lang, defaultLang string) error {
 	if lang == "" {
 		lang = defaultLang
 	}
+	if r := findLangRunnerForLang(lang); r != nil {
+		lang = r.Lexer
+	}
 	l := lexers.Get(lang)
 	if l == nil {
 		l = lexers.Analyse(source)
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// we run code from the books to capture its output. The code might
+// be buggy (infinite loop, printing forever) so we run it with
+// a timeout, limit captured output and don't pass our environment
+// variables. Each run happens in its own temporary directory with a copy
+// of source files.
+
+const (
+	runFailed         = "failed"
+	runTimeout        = "timed out"
+	runOutputTooLarge = "output too large"
+
+	// how long we wait for a killed program to exit
+	killWaitTimeout = 5 * time.Second
+)
+
+var (
+	// only those environment variables are passed to executed programs
+	runEnvWhitelist = []string{
+		"PATH", "HOME", "USER", "LANG", "TMPDIR", "TEMP", "TMP",
+		"GOPATH", "GOROOT", "GOCACHE", "GOPROXY", "GOFLAGS", "GO111MODULE",
+		// needed on Windows
+		"SystemRoot", "USERPROFILE", "LOCALAPPDATA", "APPDATA", "ComSpec",
+	}
+)
+
+// RunError describes a failed execution of a source file
+type RunError struct {
+	// path of the file being executed
+	Path string
+
+	Reason string // runFailed, runTimeout or runOutputTooLarge
+	Output string // captured output, possibly truncated
+	Err    error
+}
+
+func (e *RunError) Error() string {
+	s := fmt.Sprintf("running '%s' %s", e.Path, e.Reason)
+	if e.Err != nil {
+		s += fmt.Sprintf(" (%s)", e.Err)
+	}
+	return s
+}
+
+// returns true if the error was caused by the limits we impose and not
+// by the program itself. Those errors can't be silenced with "allow error"
+func isRunLimitError(err error) bool {
+	re, ok := err.(*RunError)
+	return ok && re.Reason != runFailed
+}
+
+// failing to get output of a source file is not fatal. We record it as
+// an error in the page with the embed but continue the build
+func reportRunError(b *Book, page *Page, blockID string, err error) {
+	reportPage(SeverityError, b, page, blockID, "%s", err)
+}
+
+// CodeRunner executes programs with time and output limits
+type CodeRunner struct {
+	Timeout       time.Duration
+	MaxOutputSize int
+	// if true, on Linux, runs in a separate network and user namespace
+	// with resource limits
+	Sandbox bool
+}
+
+var (
+	codeRunner = &CodeRunner{
+		Timeout:       30 * time.Second,
+		MaxOutputSize: 64 * 1024,
+	}
+)
+
+// limitedBuffer captures up to max bytes and calls onOverflow once
+// when more is written
+type limitedBuffer struct {
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	max        int
+	overflow   bool
+	onOverflow func()
+}
+
+func (b *limitedBuffer) Write(d []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(d)
+	if b.overflow {
+		return n, nil
+	}
+	left := b.max - b.buf.Len()
+	if n > left {
+		b.buf.Write(d[:left])
+		b.overflow = true
+		go b.onOverflow()
+		return n, nil
+	}
+	b.buf.Write(d)
+	return n, nil
+}
+
+func getScrubbedEnv() []string {
+	var res []string
+	for _, name := range runEnvWhitelist {
+		if v, ok := os.LookupEnv(name); ok {
+			res = append(res, name+"="+v)
+		}
+	}
+	return res
+}
+
+// copies regular files from srcDir (not recursively) to dstDir
+func copyFilesInDir(dstDir, srcDir string) error {
+	fileInfos, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fileInfos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		dst := filepath.Join(dstDir, fi.Name())
+		src := filepath.Join(srcDir, fi.Name())
+		err = copyFile(dst, src)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run executes exeName with args in a temporary directory that contains
+// a copy of path and other files in its directory. Paths of temporary
+// directory in the output are replaced with the original directory.
+func (r *CodeRunner) Run(path string, exeName string, args ...string) (string, error) {
+	cmd := append([]string{exeName}, args...)
+	return r.RunCmds(path, "", [][]string{cmd})
+}
+
+// RunCmds is like Run but executes a sequence of commands (e.g. compile
+// and run) in the same directory, stopping at first failure. If mainName
+// is not empty, path is also copied as mainName. Timeout applies to all
+// commands together.
+func (r *CodeRunner) RunCmds(path string, mainName string, cmds [][]string) (string, error) {
+	srcDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	err = copyFilesInDir(dir, srcDir)
+	if err == nil && mainName != "" {
+		err = copyFile(filepath.Join(dir, mainName), path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	out := &limitedBuffer{
+		max: r.MaxOutputSize,
+	}
+	deadline := time.Now().Add(r.Timeout)
+	timedOut := false
+	for _, argv := range cmds {
+		timedOut, err = r.runInDir(dir, argv, out, time.Until(deadline))
+		if err != nil {
+			break
+		}
+	}
+
+	out.mu.Lock()
+	s := out.buf.String()
+	overflow := out.overflow
+	out.mu.Unlock()
+	s = strings.Replace(s, dir, srcDir, -1)
+
+	switch {
+	case timedOut:
+		err = &RunError{Path: path, Reason: runTimeout, Output: s, Err: fmt.Errorf("killed after %s", r.Timeout)}
+	case overflow:
+		err = &RunError{Path: path, Reason: runOutputTooLarge, Output: s, Err: fmt.Errorf("more than %d bytes", r.MaxOutputSize)}
+	case err != nil:
+		err = &RunError{Path: path, Reason: runFailed, Output: s, Err: err}
+	}
+	return s, err
+}
+
+// runs a single command, killing it if it runs longer than timeout
+// or produces more output than out can hold
+func (r *CodeRunner) runInDir(dir string, argv []string, out *limitedBuffer, timeout time.Duration) (bool, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = getScrubbedEnv()
+	setupSandbox(cmd, r)
+
+	var killOnce sync.Once
+	kill := func() {
+		killOnce.Do(func() {
+			killProcessTree(cmd)
+		})
+	}
+	out.mu.Lock()
+	out.onOverflow = kill
+	out.mu.Unlock()
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	err := cmd.Start()
+	if err != nil {
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timedOut := false
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+	case <-timer.C:
+		timedOut = true
+		kill()
+		// Wait doesn't return until stdout and stderr are closed which
+		// might never happen if a process we didn't kill inherited them
+		select {
+		case err = <-done:
+		case <-time.After(killWaitTimeout):
+			err = fmt.Errorf("didn't exit %s after being killed", killWaitTimeout)
+		}
+	}
+	timer.Stop()
+	return timedOut, err
+}
@@ -26,7 +26,10 @@ func soContributorURL(userID int, userName string) string {
 }
 
 func loadSoContributorsMust(book *Book) {
-	path := filepath.Join("books", book.Dir+"_so_contributors.txt")
+	if book.SoContributorsFile == "" {
+		return
+	}
+	path := filepath.Join(booksDir, book.SoContributorsFile)
 	fmt.Printf("loadSoContributorsMust: book.Dir: %s, path: %s\n", book.Dir, path)
 	lines, err := common.ReadFileAsLines(path)
 	panicIfErr(err)
@@ -84,6 +87,7 @@ func genContributorsPage(book *Book) {
 	page := &Page{
 		Title:    "Contributors",
 		Book:     book,
+		Parent:   book.RootPage,
 		NotionID: "9999",
 		BodyHTML: template.HTML(s),
 	}
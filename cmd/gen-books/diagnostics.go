@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Problems found during the build (invalid links, source files that failed
+to run, unparsable embeds etc.) are recorded as diagnostics and the build
+continues where it can.
+
+At the end of the build we print a summary grouped by book and page,
+optionally save it as JSON (-diagnostics-json) and, with -strict, exit
+with non-zero code if there are diagnostics at or above given severity.
+*/
+
+// Severity is a severity of a diagnostic
+type Severity int
+
+const (
+	// SeverityInfo is for things worth knowing about
+	SeverityInfo Severity = iota
+	// SeverityWarning is for problems that don't break the page
+	SeverityWarning
+	// SeverityError is for problems that make the page incomplete or wrong
+	SeverityError
+)
+
+var (
+	severityNames = []string{"info", "warning", "error"}
+
+	muDiagnostics sync.Mutex
+	diagnostics   []*Diagnostic
+
+	// set with -strict. If nil, diagnostics don't fail the build
+	strictSeverity *Severity
+	// true if the last build had diagnostics at or above strictSeverity
+	diagnosticsFailedBuild bool
+	// true if the last build had diagnostics with SeverityError
+	diagnosticsHadErrors bool
+)
+
+func (s Severity) String() string {
+	if s >= 0 && int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// MarshalText is so that severity is serialized to JSON as a string
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func parseSeverity(s string) (Severity, error) {
+	for i, name := range severityNames {
+		if strings.EqualFold(s, name) {
+			return Severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity '%s', valid severities: %s", s, strings.Join(severityNames, ", "))
+}
+
+// Diagnostic describes a problem found during the build
+type Diagnostic struct {
+	Severity Severity
+	// dir of the book, empty if not specific to a book
+	Book         string `json:",omitempty"`
+	PageNotionID string `json:",omitempty"`
+	PageTitle    string `json:",omitempty"`
+	BlockID      string `json:",omitempty"`
+	Message      string
+}
+
+func (d *Diagnostic) String() string {
+	s := fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	if d.BlockID != "" {
+		s += fmt.Sprintf(" (block %s)", d.BlockID)
+	}
+	return s
+}
+
+func addDiagnostic(d *Diagnostic) {
+	// show it right away so that it's easy to tell where in the build
+	// it happened
+	fmt.Printf("%s\n", d)
+	muDiagnostics.Lock()
+	diagnostics = append(diagnostics, d)
+	muDiagnostics.Unlock()
+}
+
+// reportPage records a problem in a page. page can be nil if the problem
+// is not specific to a page and blockID can be empty
+func reportPage(sev Severity, b *Book, page *Page, blockID string, format string, args ...interface{}) {
+	d := &Diagnostic{
+		Severity: sev,
+		BlockID:  normalizeID(blockID),
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if b != nil {
+		d.Book = b.Dir
+	}
+	if page != nil {
+		d.PageNotionID = page.NotionID
+		d.PageTitle = page.Title
+	}
+	addDiagnostic(d)
+}
+
+func groupDiagnosticsKey(d *Diagnostic) string {
+	return d.Book + "/" + d.PageNotionID
+}
+
+// sorts diagnostics by book, page, severity (most severe first) and message
+func sortDiagnostics(a []*Diagnostic) {
+	sort.SliceStable(a, func(i, j int) bool {
+		d1 := a[i]
+		d2 := a[j]
+		if d1.Book != d2.Book {
+			return d1.Book < d2.Book
+		}
+		if d1.PageTitle != d2.PageTitle {
+			return d1.PageTitle < d2.PageTitle
+		}
+		if d1.PageNotionID != d2.PageNotionID {
+			return d1.PageNotionID < d2.PageNotionID
+		}
+		if d1.Severity != d2.Severity {
+			return d1.Severity > d2.Severity
+		}
+		return d1.Message < d2.Message
+	})
+}
+
+func printDiagnostics(a []*Diagnostic) {
+	if len(a) == 0 {
+		return
+	}
+	counts := make([]int, len(severityNames))
+	fmt.Printf("\nDiagnostics:\n")
+	prevKey := ""
+	for i, d := range a {
+		counts[d.Severity]++
+		key := groupDiagnosticsKey(d)
+		if i == 0 || key != prevKey {
+			prevKey = key
+			switch {
+			case d.PageNotionID != "":
+				fmt.Printf("\nBook %s, page '%s' %s%s\n", d.Book, d.PageTitle, notionBaseURL, d.PageNotionID)
+			case d.Book != "":
+				fmt.Printf("\nBook %s\n", d.Book)
+			default:
+				fmt.Printf("\nBuild\n")
+			}
+		}
+		fmt.Printf("  %s\n", d)
+	}
+	var parts []string
+	for i := len(counts) - 1; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[i], Severity(i)))
+	}
+	fmt.Printf("\n%d diagnostics: %s\n\n", len(a), strings.Join(parts, ", "))
+}
+
+func saveDiagnosticsJSON(path string, a []*Diagnostic) {
+	if a == nil {
+		a = []*Diagnostic{}
+	}
+	d, err := json.MarshalIndent(a, "", "  ")
+	panicIfErr(err)
+	createDirForFileMaybeMust(path)
+	err = writeFileAtomic(path, d)
+	if err != nil {
+		fmt.Printf("Saving diagnostics to '%s' failed with '%s'\n", path, err)
+		return
+	}
+	fmt.Printf("Saved %d diagnostics to '%s'\n", len(a), path)
+}
+
+// finishDiagnostics prints diagnostics of the build, saves them if
+// -diagnostics-json was given and clears them for the next build
+func finishDiagnostics() {
+	muDiagnostics.Lock()
+	a := diagnostics
+	diagnostics = nil
+	muDiagnostics.Unlock()
+
+	sortDiagnostics(a)
+	printDiagnostics(a)
+	if flgDiagnosticsJSON != "" {
+		saveDiagnosticsJSON(flgDiagnosticsJSON, a)
+	}
+
+	diagnosticsHadErrors = false
+	for _, d := range a {
+		if d.Severity == SeverityError {
+			diagnosticsHadErrors = true
+		}
+	}
+
+	diagnosticsFailedBuild = false
+	if strictSeverity == nil {
+		return
+	}
+	n := 0
+	for _, d := range a {
+		if d.Severity >= *strictSeverity {
+			n++
+		}
+	}
+	if n > 0 {
+		fmt.Printf("strict: %d diagnostics with severity %s or higher\n", n, *strictSeverity)
+		diagnosticsFailedBuild = true
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -36,6 +36,8 @@ var (
 		"404.tmpl.html",
 	}
 	templates = make([]*template.Template, len(templateNames))
+	// protects templates, which are lazily loaded from multiple goroutines
+	muTemplates sync.Mutex
 
 	gitHubBaseURL = "https://github.com/essentialbooks/books"
 	notionBaseURL = "https://notion.so/"
@@ -43,6 +45,8 @@ var (
 )
 
 func unloadTemplates() {
+	muTemplates.Lock()
+	defer muTemplates.Unlock()
 	templates = make([]*template.Template, len(templateNames))
 }
 
@@ -86,30 +90,42 @@ func loadTemplateMaybeMust(name string) *template.Template {
 	if ref == nil {
 		log.Fatalf("unknown template '%s'\n", name)
 	}
+	muTemplates.Lock()
+	defer muTemplates.Unlock()
 	return loadTemplateHelperMaybeMust(name, ref)
 }
 
 func execTemplateToFileSilentMaybeMust(name string, data interface{}, path string) {
+	execTemplateToFileForPage(name, data, path, nil, nil)
+}
+
+// execTemplateToFileForPage renders the template to path. Errors are
+// recorded as problems of the page (which can be nil). Returns false if
+// there were errors
+func execTemplateToFileForPage(name string, data interface{}, path string, b *Book, page *Page) bool {
 	tmpl := loadTemplateMaybeMust(name)
 	if tmpl == nil {
-		return
+		// error was reported when loading the template
+		return false
 	}
 	var buf bytes.Buffer
 	err := tmpl.Execute(&buf, data)
-	maybePanicIfErr(err)
+	// partially rendered page is better than no page
+	maybePanicIfErrPage(b, page, err)
+	ok := err == nil
 
 	d := buf.Bytes()
 	if doMinify {
 		d2, err := minifier.Bytes("text/html", d)
-		maybePanicIfErr(err)
+		maybePanicIfErrPage(b, page, err)
 		if err == nil {
-			totalHTMLBytes += len(d)
-			totalHTMLBytesMinified += len(d2)
+			addMinifiedHTMLBytes(len(d), len(d2))
 			d = d2
 		}
 	}
-	err = ioutil.WriteFile(path, d, 0644)
-	maybePanicIfErr(err)
+	err = writeOutputFile(path, d)
+	maybePanicIfErrPage(b, page, err)
+	return ok && err == nil
 }
 
 func execTemplateToFileMaybeMust(name string, data interface{}, path string) {
@@ -186,8 +202,16 @@ func genAbout() {
 	execTemplateToFileMaybeMust("about.tmpl.html", d, path)
 }
 
-// TODO: consolidate chapter/article html
-func genArticle(page *Page, currChapNo int, currArticleNo int) {
+// chapters use chapter template, pages at any deeper level use
+// article template
+func pageTemplateName(page *Page) string {
+	if page.Depth() <= 1 {
+		return "chapter.tmpl.html"
+	}
+	return "article.tmpl.html"
+}
+
+func genPage(page *Page) {
 	addSitemapURL(page.CanonnicalURL())
 
 	d := struct {
@@ -198,36 +222,31 @@ func genArticle(page *Page, currChapNo int, currArticleNo int) {
 	}{
 		PageCommon:       getPageCommon(),
 		Page:             page,
-		CurrentChapterNo: currChapNo,
-		CurrentArticleNo: currArticleNo,
+		CurrentChapterNo: page.Chapter().IndexInParent(),
+		CurrentArticleNo: page.IndexInParent(),
 	}
 
-	path := page.destFilePath()
-	execTemplateToFileSilentMaybeMust("article.tmpl.html", d, path)
-}
-
-func genChapter(page *Page, currNo int) {
-	addSitemapURL(page.CanonnicalURL())
-	for i, article := range page.Pages {
-		genArticle(article, currNo, i)
+	tmplName := pageTemplateName(page)
+	mp := newManifestPage(page, tmplName)
+	if isPageUpToDate(page, mp) {
+		return
 	}
-
 	path := page.destFilePath()
-	d := struct {
-		PageCommon
-		*Page
-		CurrentChapterNo int
-	}{
-		PageCommon:       getPageCommon(),
-		Page:             page,
-		CurrentChapterNo: currNo,
+	// if it failed, it'll be re-generated in the next build
+	if execTemplateToFileForPage(tmplName, d, path, page.Book, page) {
+		recordManifestPage(page, mp)
 	}
-	execTemplateToFileSilentMaybeMust("chapter.tmpl.html", d, path)
+}
 
-	for _, imagePath := range page.images {
-		imageName := filepath.Base(imagePath)
-		dst := page.destImagePath(imageName)
-		copyFileMaybeMust(dst, imagePath)
+// schedules generation of the page and its sub-pages, recursively,
+// on book.sem
+func genPageRecur(page *Page) {
+	book := page.Book
+	book.goLimited(func() {
+		genPage(page)
+	})
+	for _, child := range page.Pages {
+		genPageRecur(child)
 	}
 }
 
@@ -241,26 +260,39 @@ func buildIDToPage(book *Book) {
 	}
 }
 
+// each page is converted in its own goroutine. The generator only
+// modifies the page it converts, shared caches are protected by book.mu
 func bookPagesToHTML(book *Book) {
-	nProcessed := 0
 	pages := book.GetAllPages()
 	for _, page := range pages {
-		html := notionToHTML(page, book)
-		page.BodyHTML = template.HTML(string(html))
-		nProcessed++
+		page := page
+		book.goLimited(func() {
+			html := notionToHTML(page, book)
+			page.BodyHTML = template.HTML(string(html))
+		})
 	}
+	book.wg.Wait()
+	nProcessed := len(pages)
 	fmt.Printf("bookPagesToHTML: processed %d pages for book %s\n", nProcessed, book.TitleLong)
 }
 
 func genBook(book *Book) {
 	fmt.Printf("Started genering book %s\n", book.Title)
 	timeStart := time.Now()
+	book.sem = make(chan bool, getAlmostMaxProcs())
 
 	buildIDToPage(book)
 	genContributorsPage(book)
+	// images are written to www when first used in a build
+	book.images = nil
 	bookPagesToHTML(book)
+	saveHeadingAliasesIfRecorded(book)
+	setPrevNext(book)
+	setRelatedPages(book)
 
 	genBookTOCSearchMust(book)
+	genBookSearchIndexMust(book)
+	book.navHash = calcBookNavHash(book)
 
 	// generate index.html for the book
 	err := os.MkdirAll(book.destDir(), 0755)
@@ -288,9 +320,11 @@ func genBook(book *Book) {
 
 	addSitemapURL(book.CanonnicalURL())
 
-	for i, chapter := range book.Chapters() {
-		genChapter(chapter, i)
+	// genPageRecur only schedules work so we must wait for it to finish
+	for _, chapter := range book.Chapters() {
+		genPageRecur(chapter)
 	}
+	book.wg.Wait()
 
 	fmt.Printf("Generated book '%s' in %s\n", book.Title, time.Since(timeStart))
 }
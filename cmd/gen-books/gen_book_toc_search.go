@@ -33,49 +33,39 @@ const (
 	itemIdxFirstSynonym = 5
 )
 
-// TODO: make it recursive and with arbitrary nesting
-func genBookTOCSearchMust(book *Book) {
-	var toc [][]interface{}
-	for _, chapter := range book.Chapters() {
-		title := strings.TrimSpace(chapter.Title)
-		uri := chapter.URLLastPath()
-		tocItem := []interface{}{false, uri, -1, -1, title}
-		toc = append(toc, tocItem)
-		chapIdx := len(toc) - 1
-		u.PanicIf(chapIdx < 0)
+// appends toc items for the page, its headings and its sub-pages,
+// recursively
+func addPageToTOC(toc [][]interface{}, page *Page, parentIdx int) [][]interface{} {
+	title := strings.TrimSpace(page.Title)
+	uri := page.URLLastPath()
+	tocItem := []interface{}{false, uri, parentIdx, -1, title}
+	for _, syn := range page.Search {
+		tocItem = append(tocItem, syn)
+	}
+	toc = append(toc, tocItem)
+	pageIdx := len(toc) - 1
+	u.PanicIf(pageIdx < 0)
 
-		headings := chapter.Headings
-		for _, heading := range headings {
-			title := heading.Text
-			id := heading.ID
-			if len(id) > 0 {
-				id = uri + "#" + id
-			}
-			tocItem = []interface{}{false, id, chapIdx, -1, title}
-			toc = append(toc, tocItem)
+	for _, heading := range page.Headings {
+		title := heading.Text
+		id := heading.ID
+		if len(id) > 0 {
+			id = uri + "#" + id
 		}
+		tocItem = []interface{}{false, id, pageIdx, -1, title}
+		toc = append(toc, tocItem)
+	}
 
-		for _, article := range chapter.Pages {
-			title := strings.TrimSpace(article.Title)
-			uri := article.URLLastPath()
-			tocItem = []interface{}{false, uri, chapIdx, -1, title}
-			for _, syn := range article.Search {
-				tocItem = append(tocItem, syn)
-			}
-			toc = append(toc, tocItem)
+	for _, child := range page.Pages {
+		toc = addPageToTOC(toc, child, pageIdx)
+	}
+	return toc
+}
 
-			headings := article.Headings
-			articleIdx := len(toc) - 1
-			for _, heading := range headings {
-				title := heading.Text
-				id := heading.ID
-				if len(id) > 0 {
-					id = uri + "#" + id
-				}
-				tocItem = []interface{}{false, id, articleIdx, -1, title}
-				toc = append(toc, tocItem)
-			}
-		}
+func genBookTOCSearchMust(book *Book) {
+	var toc [][]interface{}
+	for _, chapter := range book.Chapters() {
+		toc = addPageToTOC(toc, chapter, -1)
 	}
 
 	// set first child idx from parent idx
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 	"strings"
 )
@@ -22,7 +21,7 @@ const (
 
 func genNetlifyHeaders() {
 	path := filepath.Join("www", "_headers")
-	err := ioutil.WriteFile(path, []byte(netlifyHeaders), 0644)
+	err := writeOutputFileMaybeMust(path, []byte(netlifyHeaders))
 	panicIfErr(err)
 }
 
@@ -33,6 +32,10 @@ func genNetlifyRedirectsForBook(b *Book) []string {
 	for _, page := range pages {
 		id := page.NotionID
 		uri := page.URLLastPath()
+		if page == b.RootPage {
+			// root page is book's index.html
+			uri = ""
+		}
 		s := fmt.Sprintf(`/essential/%s/%s* /essential/%s/%s 302`, b.Dir, id, b.Dir, uri)
 		res = append(res, s)
 	}
@@ -58,12 +61,19 @@ func genNetlifyRedirectsForBook(b *Book) []string {
 
 func genNetlifyRedirects() {
 	var a []string
-	for _, b := range books {
-		ab := genNetlifyRedirectsForBook(b)
+	for _, b := range allBooks {
+		var ab []string
+		if isBookSelected(b) {
+			ab = genNetlifyRedirectsForBook(b)
+		} else {
+			// we didn't build this book, use redirects from previous build
+			ab = prevManifest.Redirects[b.Dir]
+		}
+		currManifest.Redirects[b.Dir] = ab
 		a = append(a, ab...)
 	}
 	s := strings.Join(a, "\n")
 	path := filepath.Join("www", "_redirects")
-	err := ioutil.WriteFile(path, []byte(s), 0644)
+	err := writeOutputFileMaybeMust(path, []byte(s))
 	panicIfErr(err)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/essentialbooks/books/pkg/search"
+)
+
+/*
+Generates full-text search index of a book (see pkg/search) from html of
+its pages. It's saved in www/essential/${book}/search/ as index.json and
+one ${shard}.json for each shard, so that the client only loads shards for
+words it searches for.
+*/
+
+var (
+	rxHTMLTag = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)[^>]*>`)
+)
+
+func searchIndexDir(book *Book) string {
+	return filepath.Join(book.destDir(), "search")
+}
+
+// addHTMLToSearchIndex indexes text of html. Text inside <pre> and <code>
+// is indexed as code and inside <h1> ... <h6> as a heading
+func addHTMLToSearchIndex(idx *search.Index, docIdx int, s string) {
+	codeDepth := 0
+	headingDepth := 0
+	skipDepth := 0
+	addText := func(text string) {
+		if skipDepth > 0 || strings.TrimSpace(text) == "" {
+			return
+		}
+		text = html.UnescapeString(text)
+		field := search.FieldBody
+		if codeDepth > 0 {
+			field = search.FieldCode
+		} else if headingDepth > 0 {
+			field = search.FieldHeading
+		}
+		idx.AddText(docIdx, text, field)
+	}
+
+	prevEnd := 0
+	for _, m := range rxHTMLTag.FindAllStringSubmatchIndex(s, -1) {
+		addText(s[prevEnd:m[0]])
+		prevEnd = m[1]
+		isClose := m[3] > m[2]
+		delta := 1
+		if isClose {
+			delta = -1
+		}
+		switch strings.ToLower(s[m[4]:m[5]]) {
+		case "pre", "code":
+			codeDepth += delta
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			headingDepth += delta
+		case "script", "style":
+			skipDepth += delta
+		}
+	}
+	addText(s[prevEnd:])
+}
+
+func addPageToSearchIndex(idx *search.Index, page *Page) {
+	title := strings.TrimSpace(page.Title)
+	docIdx := idx.AddDoc(page.URL(), title)
+	idx.AddText(docIdx, title, search.FieldTitle)
+	for _, syn := range page.Search {
+		idx.AddText(docIdx, syn, search.FieldTitle)
+	}
+	addHTMLToSearchIndex(idx, docIdx, string(page.BodyHTML))
+	for _, child := range page.Pages {
+		addPageToSearchIndex(idx, child)
+	}
+}
+
+func writeJSONOutputFileMaybeMust(path string, v interface{}) int {
+	d, err := json.Marshal(v)
+	panicIfErr(err)
+	writeOutputFileMaybeMust(path, d)
+	return len(d)
+}
+
+// pages are indexed in the order of the book, which is also the order of
+// search results with the same score
+func genBookSearchIndexMust(book *Book) {
+	idx := search.NewIndex()
+	for _, chapter := range book.Chapters() {
+		addPageToSearchIndex(idx, chapter)
+	}
+
+	dir := searchIndexDir(book)
+	size := writeJSONOutputFileMaybeMust(filepath.Join(dir, "index.json"), idx.Meta())
+	for key, shard := range idx.Shards() {
+		size += writeJSONOutputFileMaybeMust(filepath.Join(dir, key+".json"), shard)
+	}
+	fmt.Printf("Search index of book %s: %d pages, %d terms, %d bytes\n", book.Title, len(idx.Docs), len(idx.Postings), size)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -44,13 +43,33 @@ func writeRobots() {
 	sitemapURL := urlJoin(siteBaseURL, "sitemap.txt")
 	robotsTxt := fmt.Sprintf(sitemapTmpl, sitemapURL)
 	robotsTxtPath := filepath.Join("www", "robots.txt")
-	err := ioutil.WriteFile(robotsTxtPath, []byte(robotsTxt), 0644)
+	err := writeOutputFileMaybeMust(robotsTxtPath, []byte(robotsTxt))
 	panicIfErr(err)
 }
 
 func writeSitemap() {
 	writeRobots()
 
+	for _, b := range allBooks {
+		prefix := b.CanonnicalURL()
+		if isBookSelected(b) {
+			var bookURLs []string
+			for uri := range sitemapURLS {
+				if strings.HasPrefix(uri, prefix) {
+					bookURLs = append(bookURLs, uri)
+				}
+			}
+			sort.Strings(bookURLs)
+			currManifest.SitemapURLs[b.Dir] = bookURLs
+			continue
+		}
+		// we didn't build this book, use urls from previous build
+		currManifest.SitemapURLs[b.Dir] = prevManifest.SitemapURLs[b.Dir]
+		for _, uri := range prevManifest.SitemapURLs[b.Dir] {
+			addSitemapURL(uri)
+		}
+	}
+
 	addSitemapURL("/")
 	addSitemapURL("about")
 
@@ -61,7 +80,7 @@ func writeSitemap() {
 	sort.Strings(urls)
 	s := strings.Join(urls, "\n")
 	sitemapPath := filepath.Join("www", "sitemap.txt")
-	err := ioutil.WriteFile(sitemapPath, []byte(s), 0644)
+	err := writeOutputFileMaybeMust(sitemapPath, []byte(s))
 	panicIfErr(err)
 
 	clearSitemapURLS()
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/essentialbooks/books/pkg/common"
+)
+
+/*
+Headings used to have ids 1, 2, 3 etc. Now their ids are derived from
+their text (see headingID) and we keep numeric ids as aliases so that
+existing links to headings still work.
+
+A numeric id was the position of the heading in the page so it changes
+when headings are added or removed. We freeze numeric ids from the last
+build that used them in cache/${book}/heading_aliases.txt, one line per
+page:
+${pageID} ${headingID for 1} ${headingID for 2} ...
+
+If the file doesn't exist, we record numeric ids in this build and save
+them. After that new headings don't get numeric aliases.
+*/
+
+type headingAliases struct {
+	path string
+	// maps page id to ids of headings, heading pageToIDs[id][i] had numeric id i+1
+	pageToIDs map[string][]string
+	// true if the file didn't exist and we record numeric ids in this build
+	recording bool
+	mu        sync.Mutex
+}
+
+func loadHeadingAliases(path string) *headingAliases {
+	res := &headingAliases{
+		path:      path,
+		pageToIDs: map[string][]string{},
+	}
+	lines, err := common.ReadFileAsLines(path)
+	if err != nil {
+		panicIf(!os.IsNotExist(err), "failed to read '%s', error: %s", path, err)
+		res.recording = true
+		return res
+	}
+	for i, s := range lines {
+		parts := strings.Fields(s)
+		if len(parts) == 0 {
+			continue
+		}
+		panicIf(!isValidNotionID(parts[0]), "unexpected line %d '%s' in '%s'", i+1, s, path)
+		res.pageToIDs[parts[0]] = parts[1:]
+	}
+	fmt.Printf("Loaded '%s' with %d pages\n", path, len(res.pageToIDs))
+	return res
+}
+
+// returns numeric alias of heading with a given id or 0 if it doesn't
+// have one. n is the position of the heading in the page
+// safe to call from multiple goroutines
+func (a *headingAliases) numericID(page *Page, headingID string, n int) int {
+	if a == nil {
+		return 0
+	}
+	pageID := normalizeID(page.NotionPage.ID)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ids := a.pageToIDs[pageID]
+	if a.recording {
+		for len(ids) < n {
+			ids = append(ids, "")
+		}
+		ids[n-1] = headingID
+		a.pageToIDs[pageID] = ids
+		return n
+	}
+	for i, id := range ids {
+		if id == headingID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func saveHeadingAliasesIfRecorded(b *Book) {
+	a := b.headingAliases
+	if a == nil || !a.recording {
+		return
+	}
+	var lines []string
+	for pageID, ids := range a.pageToIDs {
+		lines = append(lines, pageID+" "+strings.Join(ids, " ")+"\n")
+	}
+	sort.Strings(lines)
+	err := ioutil.WriteFile(a.path, []byte(strings.Join(lines, "")), 0644)
+	maybePanicIfErr(err)
+	if err != nil {
+		return
+	}
+	// numeric ids are frozen from now on
+	a.recording = false
+	fmt.Printf("Wrote '%s' with %d pages\n", a.path, len(lines))
+}
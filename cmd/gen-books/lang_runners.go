@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LangRunner describes how to run source files in a given language
+// to capture their output
+type LangRunner struct {
+	// name of the language e.g. "python"
+	Name string
+	// file extensions, with dot e.g. ".py"
+	Exts []string
+	// names repl.it uses for this language e.g. "python3"
+	ReplitLangs []string
+	// name of chroma lexer, used by htmlHighlight
+	Lexer string
+	// executable of the toolchain. If it can't be found in PATH,
+	// we skip running the files
+	Exe string
+	// prints version of the toolchain. First line of output is part of
+	// the key for cached output
+	VersionCmd []string
+	// commands executed in sequence. $file is replaced with the name
+	// of the source file in temporary directory
+	Cmds [][]string
+	// if not empty, the source file is also copied under this name
+	// to temporary directory. Some toolchains require a specific name
+	MainFileName string
+
+	lookPathOnce sync.Once
+	isAvailable  bool
+	versionOnce  sync.Once
+	version      string
+}
+
+var (
+	errRunnerNotAvailable = fmt.Errorf("toolchain not available")
+
+	langRunners = []*LangRunner{
+		&LangRunner{
+			Name:       "go",
+			Exts:       []string{".go"},
+			Lexer:      "go",
+			Exe:        "go",
+			VersionCmd: []string{"go", "version"},
+			Cmds:       [][]string{{"go", "run", "$file"}},
+		},
+		&LangRunner{
+			Name:        "python",
+			Exts:        []string{".py"},
+			ReplitLangs: []string{"python3", "python"},
+			Lexer:       "python",
+			Exe:         "python3",
+			VersionCmd:  []string{"python3", "--version"},
+			Cmds:        [][]string{{"python3", "$file"}},
+		},
+		&LangRunner{
+			Name:        "javascript",
+			Exts:        []string{".js"},
+			ReplitLangs: []string{"nodejs", "javascript"},
+			Lexer:       "javascript",
+			Exe:         "node",
+			VersionCmd:  []string{"node", "--version"},
+			Cmds:        [][]string{{"node", "$file"}},
+		},
+		&LangRunner{
+			Name:        "bash",
+			Exts:        []string{".sh"},
+			ReplitLangs: []string{"bash"},
+			Lexer:       "bash",
+			Exe:         "bash",
+			VersionCmd:  []string{"bash", "--version"},
+			Cmds:        [][]string{{"bash", "$file"}},
+		},
+		&LangRunner{
+			Name:        "c",
+			Exts:        []string{".c"},
+			ReplitLangs: []string{"c"},
+			Lexer:       "c",
+			Exe:         "cc",
+			VersionCmd:  []string{"cc", "--version"},
+			Cmds: [][]string{
+				{"cc", "-o", "main.exe", "$file"},
+				{"./main.exe"},
+			},
+		},
+		&LangRunner{
+			Name:        "rust",
+			Exts:        []string{".rs"},
+			ReplitLangs: []string{"rust"},
+			Lexer:       "rust",
+			Exe:         "rustc",
+			VersionCmd:  []string{"rustc", "--version"},
+			Cmds: [][]string{
+				{"rustc", "-o", "main.exe", "$file"},
+				{"./main.exe"},
+			},
+		},
+	}
+)
+
+// IsAvailable returns true if toolchain for this language is installed
+func (r *LangRunner) IsAvailable() bool {
+	r.lookPathOnce.Do(func() {
+		_, err := exec.LookPath(r.Exe)
+		r.isAvailable = err == nil
+		if !r.isAvailable {
+			fmt.Printf("'%s' not found, will not run %s files\n", r.Exe, r.Name)
+		}
+	})
+	return r.isAvailable
+}
+
+// Version returns version of the toolchain or empty string if not available
+func (r *LangRunner) Version() string {
+	r.versionOnce.Do(func() {
+		if !r.IsAvailable() {
+			return
+		}
+		out, err := exec.Command(r.VersionCmd[0], r.VersionCmd[1:]...).CombinedOutput()
+		if err != nil {
+			fmt.Printf("'%s' failed with '%s'\n", strings.Join(r.VersionCmd, " "), err)
+			return
+		}
+		lines := strings.Split(string(out), "\n")
+		r.version = strings.TrimSpace(lines[0])
+	})
+	return r.version
+}
+
+// Run runs a source file and returns its output
+func (r *LangRunner) Run(path string) (string, error) {
+	if !r.IsAvailable() {
+		return "", errRunnerNotAvailable
+	}
+	fileName := filepath.Base(path)
+	if r.MainFileName != "" {
+		fileName = r.MainFileName
+	}
+	var cmds [][]string
+	for _, cmd := range r.Cmds {
+		var args []string
+		for _, arg := range cmd {
+			if arg == "$file" {
+				arg = fileName
+			}
+			args = append(args, arg)
+		}
+		cmds = append(cmds, args)
+	}
+	return codeRunner.RunCmds(path, r.MainFileName, cmds)
+}
+
+// returns nil if we don't know how to run files with this extension
+func findLangRunnerForFile(fileName string) *LangRunner {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, r := range langRunners {
+		for _, e := range r.Exts {
+			if e == ext {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// lang can be our name or name used by repl.it
+func findLangRunnerForLang(lang string) *LangRunner {
+	lang = strings.ToLower(lang)
+	for _, r := range langRunners {
+		if r.Name == lang {
+			return r
+		}
+		for _, l := range r.ReplitLangs {
+			if l == lang {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// returns runner whose toolchain executable is exe e.g. "go"
+func findLangRunnerForExe(exe string) *LangRunner {
+	for _, r := range langRunners {
+		if r.Exe == exe {
+			return r
+		}
+	}
+	return nil
+}
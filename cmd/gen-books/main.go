@@ -25,11 +25,23 @@ var (
 	flgAnalytics      string
 	flgPreview        bool
 	flgNoCache        bool
+	flgRefreshChanged bool
 	flgRecreateOutput bool
+	flgRecreateOutputFor string
 	flgUpdateOutput   bool
+	flgGCCache        bool
+	flgVerifyOutput   bool
 	flgRedownloadReplit bool
 	flgRedownloadOne string
+	flgDownloadImages bool
 	flgRedownloadOneReplit string
+	flgSnapshotExport      string
+	flgSnapshotImport      string
+	flgBooks               string
+	flgDiagnosticsJSON     string
+	flgStrict              string
+	flgCheckLinks          bool
+	flgCheckExternalLinks  bool
 
 	soUserIDToNameMap map[int]string
 	googleAnalytics   template.HTML
@@ -38,29 +50,54 @@ var (
 )
 
 var (
-	books = []*Book{
-		&Book{
-			Title:     "Go",
-			TitleLong: "Essential Go",
-			Dir:       "go",
-			// https://www.notion.so/2cab1ed2b7a44584b56b0d3ca9b80185
-			NotionStartPageID: "2cab1ed2b7a44584b56b0d3ca9b80185",
-		},
-	}
+	// loaded from books/${dir}/book.txt
+	allBooks []*Book
+	// books we build, selected with -book. All books by default
+	books []*Book
 )
 
 func parseFlags() {
 	flag.StringVar(&flgAnalytics, "analytics", "", "google analytics code")
 	flag.BoolVar(&flgPreview, "preview", false, "if true will start watching for file changes and re-build everything")
 	flag.BoolVar(&flgRecreateOutput, "recreate-output", false, "if true, recreates ouput files in cache")
+	flag.StringVar(&flgRecreateOutputFor, "recreate-output-for", "", "notion id of a page or path of a file for which to recreate output in cache")
 	flag.BoolVar(&flgUpdateOutput, "update-output", false, "if true, will update ouput files in cache")
+	flag.BoolVar(&flgVerifyOutput, "verify-output", false, "if true, re-runs source files and fails if output is different than cached output")
+	flag.BoolVar(&flgGCCache, "gc-cache", false, "if true, removes unused entries from output, go playground and replit caches")
 	flag.BoolVar(&flgNoCache, "no-cache", false, "if true, disables cache for notion")
+	flag.BoolVar(&flgRefreshChanged, "refresh-changed", false, "if true, re-downloads notion pages that changed since they were cached")
 	flag.StringVar(&flgRedownloadOne, "redownload-one", "", "notion id of a page to re-download")
+	flag.BoolVar(&flgDownloadImages, "download-images", false, "if true, downloads images missing in the cache for notion pages loaded from the cache")
 	flag.BoolVar(&flgRedownloadReplit, "redownload-replit", false, "if true, redownloads replits")
 	flag.StringVar(&flgRedownloadOneReplit, "redownload-one-replit", "", "replit url and book to download")
+	flag.StringVar(&flgBooks, "book", "", "comma separated dirs of books to build e.g. 'go,python'. All books by default")
+	flag.StringVar(&flgSnapshotExport, "snapshot-export", "", "path of .zip file to which to export notion, replit and output caches")
+	flag.StringVar(&flgSnapshotImport, "snapshot-import", "", "path of .zip file created with -snapshot-export from which to import caches")
+	flag.DurationVar(&codeRunner.Timeout, "run-timeout", codeRunner.Timeout, "max time for running a single source file to capture its output")
+	flag.IntVar(&codeRunner.MaxOutputSize, "run-max-output", codeRunner.MaxOutputSize, "max size of captured output of a source file, in bytes")
+	flag.IntVar(&notionDownloader.Workers, "notion-workers", notionDownloader.Workers, "number of pages downloaded from notion in parallel")
+	flag.Float64Var(&notionDownloader.RequestsPerSecond, "notion-rps", notionDownloader.RequestsPerSecond, "max number of requests per second sent to notion, 0 for no limit")
+	flag.IntVar(&notionDownloader.MaxTries, "notion-max-tries", notionDownloader.MaxTries, "max number of attempts to download a notion page")
+	flag.BoolVar(&codeRunner.Sandbox, "run-sandbox", false, "if true, runs source files in a sandbox (Linux only)")
+	flag.StringVar(&flgDiagnosticsJSON, "diagnostics-json", "", "path of .json file to which to save problems found during the build")
+	flag.BoolVar(&flgCheckLinks, "check-links", false, "if true, checks links in generated website")
+	flag.BoolVar(&flgCheckExternalLinks, "check-external-links", false, "if true, also checks external links in generated website (implies -check-links)")
+	flag.StringVar(&flgStrict, "strict", "", "if 'info', 'warning' or 'error', build fails if there are problems of this or higher severity")
 
 	flag.Parse()
 
+	if flgStrict != "" {
+		sev, err := parseSeverity(flgStrict)
+		if err != nil {
+			fmt.Printf("invalid -strict: %s\n", err)
+			os.Exit(1)
+		}
+		strictSeverity = &sev
+	}
+	// problems are recorded as diagnostics and the build continues.
+	// -strict only decides the exit code, after the summary is printed
+	softErrorMode = true
+
 	if flgAnalytics != "" {
 		googleAnalyticsTmpl := `<script async src="https://www.googletagmanager.com/gtag/js?id=%s"></script>
 		<script>
@@ -78,8 +115,19 @@ func parseFlags() {
 func downloadBook(c *notionapi.Client, book *Book) {
 	notionStartPageID := book.NotionStartPageID
 	book.pageIDToPage = map[string]*notionapi.Page{}
-	loadNotionPages(book, c, notionStartPageID, book.pageIDToPage, !flgNoCache)
+	if flgRefreshChanged {
+		refreshChangedPages(book, c, book.pageIDToPage)
+	} else {
+		loadNotionPages(book, c, notionStartPageID, book.pageIDToPage, !flgNoCache)
+	}
 	fmt.Printf("Loaded %d pages for book %s\n", len(book.pageIDToPage), book.Title)
+	// images of downloaded pages are already downloaded but pages
+	// from the cache might have been cached before we cached images
+	if flgDownloadImages {
+		for _, page := range book.pageIDToPage {
+			downloadPageImages(book, page)
+		}
+	}
 	bookFromPages(book)
 }
 
@@ -89,28 +137,6 @@ func loadSOUserMappingsMust() {
 	u.PanicIfErr(err)
 }
 
-// TODO: probably more
-func getDefaultLangForBook(bookName string) string {
-	s := strings.ToLower(bookName)
-	switch s {
-	case "go":
-		return "go"
-	case "android":
-		return "java"
-	case "ios":
-		return "ObjectiveC"
-	case "microsoft sql server":
-		return "sql"
-	case "node.js":
-		return "javascript"
-	case "mysql":
-		return "sql"
-	case ".net framework":
-		return "c#"
-	}
-	return s
-}
-
 func shouldCopyImage(path string) bool {
 	return !strings.Contains(path, "@2x")
 }
@@ -161,7 +187,7 @@ func copyToWwwAsSha1MaybeMust(srcName string) {
 	sha1Hex := u.Sha1HexOfBytes(d)
 	name := nameToSha1Name(srcName, sha1Hex)
 	dst := filepath.Join("www", "s", name)
-	err = ioutil.WriteFile(dst, d, 0644)
+	err = writeOutputFileMaybeMust(dst, d)
 	panicIfErr(err)
 	*dstPtr = filepath.ToSlash(dst[len("www"):])
 	fmt.Printf("Copied %s => %s\n", src, dst)
@@ -177,8 +203,12 @@ func genAllBooks() {
 	copyToWwwAsSha1MaybeMust("main.css")
 	copyToWwwAsSha1MaybeMust("app.js")
 	copyToWwwAsSha1MaybeMust("favicon.ico")
-	genIndex(books)
-	genIndexGrid(books)
+	// index pages show info about all books so we only re-generate
+	// them when building all books
+	if !isPartialBuild() {
+		genIndex(books)
+		genIndexGrid(books)
+	}
 	gen404TopLevel()
 	genAbout()
 	genFeedback()
@@ -204,8 +234,9 @@ func initMinify() {
 	doMinify = !flgPreview
 }
 
+// returns a book with a given dir, including books not selected with -book
 func findBookFromDir(dir string) *Book {
-	for _, book := range books {
+	for _, book := range allBooks {
 		if book.Dir == dir {
 			return book
 		}
@@ -236,6 +267,9 @@ func findBookFromCachedPageID(id string) *Book {
 		dir := fi.Name()
 		book := findBookFromDir(dir)
 		panicIf(book == nil, "didn't find book for dir '%s'", dir)
+		if !isBookSelected(book) {
+			continue
+		}
 		if isNotionCachedInDir(filepath.Join("cache", dir, "notion"), id) {
 			return book
 		}
@@ -275,9 +309,35 @@ func redownloadOneReplit() {
 	fmt.Printf("genReplitEmbed: downloaded %s,  isNew: %v\n", uri+".zip", isNew)
 }
 
+// loads books from notion cache and generates the website.
+// Can be called multiple times e.g. when re-building in preview mode
+func loadAndGenAllBooks(client *notionapi.Client) {
+	for _, book := range books {
+		downloadBook(client, book)
+		loadSoContributorsMust(book)
+	}
+
+	genAllBooks()
+	genNetlifyHeaders()
+	genNetlifyRedirects()
+	finishBuildManifest()
+	if flgCheckLinks || flgCheckExternalLinks {
+		checkLinks()
+	}
+	printAndClearErrors()
+
+	saveOutput := flgUpdateOutput || flgRedownloadOne != "" || flgRecreateOutput || flgRecreateOutputFor != ""
+	for _, b := range books {
+		// migration of legacy cached output must be saved so that we
+		// don't use output created by a different toolchain later
+		if saveOutput || b.migrateLegacyOutput {
+			saveCachedOutputFiles(b)
+		}
+	}
+}
+
 func initBook(book *Book) {
 	var err error
-	book.titleSafe = common.MakeURLSafe(book.Title)
 
 	createDirMust(book.OutputCacheDir())
 	createDirMust(book.NotionCacheDir())
@@ -287,26 +347,41 @@ func initBook(book *Book) {
 	book.sha1ToGoPlaygroundCache = readSha1ToGoPlaygroundCache(path)
 	book.replitCache, err = LoadReplitCache(book.ReplitCachePath())
 	panicIfErr(err)
+	loadToolchainVersions(book)
+	book.headingAliases = loadHeadingAliases(book.HeadingAliasesPath())
+	book.cacheUsage = newCacheUsage()
 }
 
 func main() {
 	parseFlags()
+	allBooks = loadBooksMust()
+	books = selectBooksMust(allBooks, flgBooks)
 
 	if flgRedownloadOneReplit != "" {
 		redownloadOneReplit()
 		os.Exit(0)
 	}
 
+	if flgSnapshotExport != "" {
+		exportSnapshotMust(flgSnapshotExport)
+		os.Exit(0)
+	}
+
+	if flgSnapshotImport != "" {
+		importSnapshotMust(flgSnapshotImport)
+		os.Exit(0)
+	}
+
 	if false {
 		// only needs to be run when we add new covers
 		genTwitterImagesAndExit()
 	}
 
-	os.RemoveAll("www")
-	createDirMust(filepath.Join("www", "s"))
 	createDirMust("log")
+	initBuildManifest()
+	createDirMust(filepath.Join("www", "s"))
 
-	client := &notionapi.Client{}
+	client := newNotionClient()
 	if flgRedownloadOne != "" {
 		book := findBookFromCachedPageID(flgRedownloadOne)
 		if book == nil {
@@ -327,31 +402,24 @@ func main() {
 	initMinify()
 	loadSOUserMappingsMust()
 
-	if flgUpdateOutput {
-		// TODO: must be done somewhere else
-		if flgRecreateOutput {
-			//os.RemoveAll(cachedOutputDir)
-		}
-	}
-
 	for _, book := range books {
 		initBook(book)
-		downloadBook(client, book)
-		loadSoContributorsMust(book)
 	}
+	loadAndGenAllBooks(client)
 
-	genAllBooks()
-	genNetlifyHeaders()
-	genNetlifyRedirects()
-	printAndClearErrors()
+	if flgGCCache {
+		gcCaches()
+	}
 
-	if flgUpdateOutput || flgRedownloadOne != "" {
-		for _, b := range books {
-			saveCachedOutputFiles(b)
-		}
+	if flgVerifyOutput && printOutputMismatches() > 0 {
+		os.Exit(1)
 	}
 
 	if flgPreview {
-		startPreview()
+		startPreview(client)
+	}
+
+	if diagnosticsFailedBuild {
+		os.Exit(1)
 	}
 }
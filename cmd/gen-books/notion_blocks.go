@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/alecthomas/template"
+	"github.com/kjk/notionapi"
+)
+
+/*
+Block types that notionapi doesn't know about (or knows but doesn't parse
+much of) and are rendered with sensible fallbacks: callouts, equations,
+video / audio / file / pdf, table of contents, breadcrumb and synced blocks.
+
+notionapi only parses format of some block types so we parse what we need
+from raw format ourselves.
+
+Block types we still don't know are reported as diagnostics. Their text and
+children are still shown so that the content is not lost.
+*/
+
+// types of blocks not defined in notionapi
+const (
+	blockCallout         = "callout"
+	blockEquation        = "equation"
+	blockPDF             = "pdf"
+	blockAudio           = "audio"
+	blockTableOfContents = "table_of_contents"
+	blockBreadcrumb      = "breadcrumb"
+	// original synced block
+	blockSyncedBlock = "transclusion_container"
+	// copy of synced block, points to the original
+	blockSyncedBlockRef = "transclusion_reference"
+)
+
+const (
+	defaultCalloutIcon = "💡"
+	// table of contents must list all headings of the page, including those
+	// after it, so it's generated at the end
+	tocPlaceholder = "<!-- table of contents -->"
+)
+
+// blockFormat has fields of raw format of a block not parsed by notionapi
+type blockFormat struct {
+	BlockColor    string `json:"block_color"`
+	PageIcon      string `json:"page_icon"`
+	DisplaySource string `json:"display_source"`
+	// for synced block copy
+	TransclusionReferencePointer *struct {
+		ID string `json:"id"`
+	} `json:"transclusion_reference_pointer"`
+}
+
+func getBlockFormat(block *notionapi.Block) *blockFormat {
+	var f blockFormat
+	if len(block.FormatRaw) > 0 {
+		// a format we can't parse is treated as empty
+		_ = json.Unmarshal(block.FormatRaw, &f)
+	}
+	return &f
+}
+
+// returns url of video / audio / file / pdf
+func getBlockSourceURL(block *notionapi.Block) string {
+	if block.Source != "" {
+		return block.Source
+	}
+	return getBlockFormat(block).DisplaySource
+}
+
+// returns name of a file from its url e.g. "foo.pdf"
+func fileNameFromURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return uri
+	}
+	if s, err := url.PathUnescape(name); err == nil {
+		name = s
+	}
+	return name
+}
+
+func (g *HTMLGenerator) genCallout(block *notionapi.Block, levelCls string) {
+	f := getBlockFormat(block)
+	cls := "callout" + levelCls
+	if f.BlockColor != "" {
+		cls += " callout-" + f.BlockColor
+	}
+	icon := f.PageIcon
+	if icon == "" {
+		icon = defaultCalloutIcon
+	}
+	iconHTML := template.HTMLEscapeString(icon)
+	if strings.HasPrefix(icon, "http") {
+		iconHTML = fmt.Sprintf(`<img src="%s" alt="">`, template.HTMLEscapeString(icon))
+	}
+	start := fmt.Sprintf(`<div class="%s"><div class="callout-icon">%s</div><div class="callout-text">`, cls, iconHTML)
+	close := `</div></div>`
+	g.genBlockSurrouded(block, start, close)
+}
+
+// we don't render TeX so we show the source of an equation
+func (g *HTMLGenerator) genEquation(block *notionapi.Block, levelCls string) {
+	tex := genInlineBlocksText(block.InlineContent)
+	fmt.Fprintf(g.f, `<div class="equation%s"><code>%s</code></div>`+"\n", levelCls, template.HTMLEscapeString(tex))
+}
+
+// returns url for embedding youtube or vimeo video or empty string if
+// it's a different video
+func getVideoEmbedURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(u.Host, "www.")
+	switch host {
+	case "youtube.com", "m.youtube.com":
+		if id := u.Query().Get("v"); id != "" {
+			return "https://www.youtube.com/embed/" + id
+		}
+		if strings.HasPrefix(u.Path, "/embed/") {
+			return uri
+		}
+	case "youtu.be":
+		return "https://www.youtube.com/embed" + u.Path
+	case "vimeo.com":
+		return "https://player.vimeo.com/video" + u.Path
+	case "player.vimeo.com":
+		return uri
+	}
+	return ""
+}
+
+func (g *HTMLGenerator) genVideo(block *notionapi.Block, levelCls string) {
+	uri := getBlockSourceURL(block)
+	if uri == "" {
+		g.report(SeverityWarning, block, "video without url")
+		return
+	}
+	uriEsc := template.HTMLEscapeString(uri)
+	if embedURL := getVideoEmbedURL(uri); embedURL != "" {
+		fmt.Fprintf(g.f, `<div class="video%s"><iframe src="%s" frameborder="0" allowfullscreen></iframe></div>`+"\n", levelCls, template.HTMLEscapeString(embedURL))
+		return
+	}
+	// <video> shows a link if a browser can't play the video
+	fmt.Fprintf(g.f, `<div class="video%s"><video controls preload="metadata" src="%s"><a href="%s">%s</a></video></div>`+"\n", levelCls, uriEsc, uriEsc, template.HTMLEscapeString(fileNameFromURL(uri)))
+}
+
+func (g *HTMLGenerator) genAudio(block *notionapi.Block, levelCls string) {
+	uri := getBlockSourceURL(block)
+	if uri == "" {
+		g.report(SeverityWarning, block, "audio without url")
+		return
+	}
+	uriEsc := template.HTMLEscapeString(uri)
+	fmt.Fprintf(g.f, `<div class="audio%s"><audio controls preload="metadata" src="%s"><a href="%s">%s</a></audio></div>`+"\n", levelCls, uriEsc, uriEsc, template.HTMLEscapeString(fileNameFromURL(uri)))
+}
+
+// returns html of a link to file with its name and size
+func (g *HTMLGenerator) fileLinkHTML(block *notionapi.Block, uri string) string {
+	name := genInlineBlocksText(block.InlineContent)
+	if name == "" {
+		name = fileNameFromURL(uri)
+	}
+	s := fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(uri), template.HTMLEscapeString(name))
+	size := block.FileSize
+	if size == "" {
+		size = propsValueToText(block.Properties["size"])
+	}
+	if size != "" {
+		s += fmt.Sprintf(` <span class="file-size">%s</span>`, template.HTMLEscapeString(size))
+	}
+	return s
+}
+
+func (g *HTMLGenerator) genFile(block *notionapi.Block, levelCls string) {
+	uri := getBlockSourceURL(block)
+	if uri == "" {
+		g.report(SeverityWarning, block, "file without url")
+		return
+	}
+	fmt.Fprintf(g.f, `<div class="file%s">%s</div>`+"\n", levelCls, g.fileLinkHTML(block, uri))
+}
+
+// pdf is shown inline if the browser can and as a link otherwise
+func (g *HTMLGenerator) genPDF(block *notionapi.Block, levelCls string) {
+	uri := getBlockSourceURL(block)
+	if uri == "" {
+		g.report(SeverityWarning, block, "pdf without url")
+		return
+	}
+	link := g.fileLinkHTML(block, uri)
+	fmt.Fprintf(g.f, `<div class="pdf%s"><object data="%s" type="application/pdf"><div class="file">%s</div></object></div>`+"\n", levelCls, template.HTMLEscapeString(uri), link)
+}
+
+func (g *HTMLGenerator) genTableOfContents(levelCls string) {
+	fmt.Fprintf(g.f, `<div class="page-toc%s">%s</div>`+"\n", levelCls, tocPlaceholder)
+}
+
+// returns html of links to headings of the page
+func (g *HTMLGenerator) tableOfContentsHTML() string {
+	var buf bytes.Buffer
+	for _, h := range g.page.Headings {
+		fmt.Fprintf(&buf, `<div><a href="#%s">%s</a></div>`, h.ID, template.HTMLEscapeString(h.Text))
+	}
+	return buf.String()
+}
+
+func (g *HTMLGenerator) genBreadcrumb(levelCls string) {
+	page := g.page
+	var links []string
+	add := func(uri, title string) {
+		links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, uri, template.HTMLEscapeString(title)))
+	}
+	add(g.book.URL(), g.book.Title)
+	for _, p := range page.BreadcrumbPages() {
+		add(p.URL(), p.Title)
+	}
+	// chapters have root page of the book as a parent
+	if page.Parent != nil && page.Parent.Parent != nil {
+		add(page.Parent.URL(), page.Parent.Title)
+	}
+	links = append(links, template.HTMLEscapeString(page.Title))
+	fmt.Fprintf(g.f, `<div class="breadcrumb%s">%s</div>`+"\n", levelCls, strings.Join(links, ` / `))
+}
+
+func findBlockByIDRecur(block *notionapi.Block, id string) *notionapi.Block {
+	if block == nil {
+		return nil
+	}
+	if normalizeID(block.ID) == id {
+		return block
+	}
+	for _, child := range block.Content {
+		if b := findBlockByIDRecur(child, id); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// original of synced block is usually in a different page so we look for
+// it in all pages of the book
+func (g *HTMLGenerator) findBlockByID(id string) *notionapi.Block {
+	id = normalizeID(id)
+	if b := findBlockByIDRecur(g.page.NotionPage.Root, id); b != nil {
+		return b
+	}
+	for _, page := range g.book.pageIDToPage {
+		if b := findBlockByIDRecur(page.Root, id); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func (g *HTMLGenerator) genSyncedBlockRef(block *notionapi.Block) {
+	ptr := getBlockFormat(block).TransclusionReferencePointer
+	if ptr == nil || ptr.ID == "" {
+		g.report(SeverityWarning, block, "synced block without original block")
+		return
+	}
+	orig := g.findBlockByID(ptr.ID)
+	if orig == nil {
+		g.report(SeverityWarning, block, "didn't find original '%s' of synced block", ptr.ID)
+		return
+	}
+	// original is a synced block so its children are the content
+	g.genContent(orig)
+}
+
+// we don't know how to render the block but its text and children are
+// better than nothing
+func (g *HTMLGenerator) genUnsupportedBlock(block *notionapi.Block, levelCls string) {
+	g.report(SeverityError, block, "unsupported block type '%s'", block.Type)
+	if len(block.InlineContent) == 0 && len(block.Content) == 0 {
+		return
+	}
+	start := fmt.Sprintf(`<div class="unsupported-block%s">`, levelCls)
+	close := `</div>`
+	g.genBlockSurrouded(block, start, close)
+}
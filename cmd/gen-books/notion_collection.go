@@ -0,0 +1,718 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/notionapi"
+)
+
+/*
+Collection views (tables) in a page.
+
+notionapi doesn't keep sort and filter of a view nor number format of
+columns so when downloading a page we also save raw collection and
+collection_view records from notion's responses in
+cache/${book}/notion/records/${pageID}.json.
+
+Cells are rich text like other inline content:
+[
+	["foo", [["b"], ["a", "https://..."]]],
+	["‣", [["d", { "start_date": "2018-07-12", ... }]]]
+]
+and are formatted according to the type of column in collection's schema.
+*/
+
+// notionRawRecords are records from notion's responses for a single page
+type notionRawRecords struct {
+	// maps id to a record
+	Collections     map[string]json.RawMessage `json:"collection"`
+	CollectionViews map[string]json.RawMessage `json:"collection_view"`
+}
+
+func newNotionRawRecords() *notionRawRecords {
+	return &notionRawRecords{
+		Collections:     map[string]json.RawMessage{},
+		CollectionViews: map[string]json.RawMessage{},
+	}
+}
+
+// rawRecordsInterceptor is notionapi.HTTPInterceptor that remembers raw
+// records from responses
+type rawRecordsInterceptor struct {
+	mu      sync.Mutex
+	records *notionRawRecords
+}
+
+func (i *rawRecordsInterceptor) OnRequest(*http.Request) *http.Response {
+	return nil
+}
+
+func (i *rawRecordsInterceptor) OnResponse(rsp *http.Response) {
+	d, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(d))
+	if err != nil {
+		return
+	}
+	type recordWithRole struct {
+		Value json.RawMessage `json:"value"`
+	}
+	var v struct {
+		RecordMap struct {
+			Collections     map[string]*recordWithRole `json:"collection"`
+			CollectionViews map[string]*recordWithRole `json:"collection_view"`
+		} `json:"recordMap"`
+	}
+	if json.Unmarshal(d, &v) != nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for id, r := range v.RecordMap.Collections {
+		if r != nil && len(r.Value) > 0 {
+			i.records.Collections[id] = r.Value
+		}
+	}
+	for id, r := range v.RecordMap.CollectionViews {
+		if r != nil && len(r.Value) > 0 {
+			i.records.CollectionViews[id] = r.Value
+		}
+	}
+}
+
+func notionRecordsPath(b *Book, pageID string) string {
+	return filepath.Join(b.NotionCacheDir(), "records", normalizeID(pageID)+".json")
+}
+
+// saves records of the page, if it has any collection views
+func saveNotionRawRecords(b *Book, pageID string, records *notionRawRecords) {
+	path := notionRecordsPath(b, pageID)
+	if len(records.CollectionViews) == 0 {
+		if pathExists(path) {
+			rmFile(path)
+		}
+		return
+	}
+	d, err := json.MarshalIndent(records, "", "  ")
+	panicIfErr(err)
+	createDirForFileMaybeMust(path)
+	err = writeFileAtomic(path, d)
+	if err != nil {
+		// not fatal, we'll show views unsorted and unfiltered
+		fmt.Printf("Saving '%s' failed with '%s'\n", path, err)
+	}
+}
+
+// returns nil if we don't have records for the page
+func loadNotionRawRecords(b *Book, pageID string) *notionRawRecords {
+	d, err := ioutil.ReadFile(notionRecordsPath(b, pageID))
+	if err != nil {
+		return nil
+	}
+	var res notionRawRecords
+	if err = json.Unmarshal(d, &res); err != nil {
+		fmt.Printf("loadNotionRawRecords: json.Unmarshal() failed with '%s'\n", err)
+		return nil
+	}
+	return &res
+}
+
+type viewSort struct {
+	Property string `json:"property"`
+	// "ascending" or "descending"
+	Type string `json:"type"`
+}
+
+type viewFilter struct {
+	Property string `json:"property"`
+	// e.g. "string_contains", "enum_is", "number_greater_than"
+	Comparator string      `json:"comparator"`
+	Value      interface{} `json:"value"`
+}
+
+type viewQuery struct {
+	Sort   []*viewSort   `json:"sort"`
+	Filter []*viewFilter `json:"filter"`
+	// "and" or "or"
+	FilterOperator string `json:"filter_operator"`
+}
+
+// columnFormat is what we need from raw collection schema
+type columnFormat struct {
+	// "number", "number_with_commas", "percent", "dollar" etc.
+	NumberFormat string `json:"number_format"`
+}
+
+func (r *notionRawRecords) viewQuery(viewID string) *viewQuery {
+	var v struct {
+		Query *viewQuery `json:"query"`
+	}
+	if r == nil || json.Unmarshal(r.CollectionViews[viewID], &v) != nil {
+		return nil
+	}
+	return v.Query
+}
+
+func (r *notionRawRecords) columnFormats(collectionID string) map[string]*columnFormat {
+	var v struct {
+		Schema map[string]*columnFormat `json:"schema"`
+	}
+	if r == nil || json.Unmarshal(r.Collections[collectionID], &v) != nil {
+		return nil
+	}
+	return v.Schema
+}
+
+// collectionTable is a collection view prepared for rendering
+type collectionTable struct {
+	viewInfo *notionapi.CollectionViewInfo
+	columns  []*notionapi.TableProperty
+	schema   map[string]*notionapi.CollectionColumnInfo
+	formats  map[string]*columnFormat
+	rows     []*notionapi.Block
+}
+
+func (t *collectionTable) columnType(property string) string {
+	if info := t.schema[property]; info != nil {
+		return info.Type
+	}
+	return ""
+}
+
+// returns plain text of a cell, used for sorting and filtering. Dates are
+// "2018-07-12"
+func cellText(v interface{}) string {
+	items, _ := v.([]interface{})
+	var a []string
+	for _, item := range items {
+		parts, _ := item.([]interface{})
+		if len(parts) == 0 {
+			continue
+		}
+		s, _ := parts[0].(string)
+		if d := cellDate([]interface{}{item}); d != nil {
+			s = d.StartDate
+		}
+		a = append(a, s)
+	}
+	return strings.Join(a, "")
+}
+
+// returns the first date in a cell
+func cellDate(v interface{}) *notionDate {
+	block := &notionapi.Block{
+		Properties: map[string]interface{}{"title": v},
+	}
+	dates := getRawDates(block)
+	if len(dates) == 0 {
+		return nil
+	}
+	return dates[0]
+}
+
+func cellNumber(v interface{}) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(cellText(v)), 64)
+	return f, err == nil
+}
+
+func cellChecked(v interface{}) bool {
+	return strings.EqualFold(cellText(v), "Yes")
+}
+
+// returns values of a select or multi-select cell
+func cellOptions(v interface{}) []string {
+	var res []string
+	for _, s := range strings.Split(cellText(v), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// returns a value comparable with other values of the same column
+func (t *collectionTable) cellSortKey(row *notionapi.Block, property string) interface{} {
+	v := row.Properties[property]
+	switch t.columnType(property) {
+	case "number":
+		if f, ok := cellNumber(v); ok {
+			return f
+		}
+		return nil
+	case "checkbox":
+		return cellChecked(v)
+	case "created_time":
+		return float64(row.CreatedTime)
+	case "last_edited_time":
+		return float64(row.LastEditedTime)
+	}
+	s := strings.ToLower(cellText(v))
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// returns -1, 0, 1. Empty values are always last
+func compareSortKeys(k1, k2 interface{}) int {
+	if k1 == nil || k2 == nil {
+		switch {
+		case k1 == nil && k2 == nil:
+			return 0
+		case k1 == nil:
+			return 1
+		}
+		return -1
+	}
+	switch v1 := k1.(type) {
+	case float64:
+		v2 := k2.(float64)
+		if v1 < v2 {
+			return -1
+		} else if v1 > v2 {
+			return 1
+		}
+	case bool:
+		v2 := k2.(bool)
+		if v1 != v2 {
+			if !v1 {
+				return -1
+			}
+			return 1
+		}
+	case string:
+		return strings.Compare(v1, k2.(string))
+	}
+	return 0
+}
+
+func (t *collectionTable) sortRows(sorts []*viewSort) {
+	if len(sorts) == 0 {
+		return
+	}
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		for _, s := range sorts {
+			k1 := t.cellSortKey(t.rows[i], s.Property)
+			k2 := t.cellSortKey(t.rows[j], s.Property)
+			c := compareSortKeys(k1, k2)
+			if c == 0 {
+				continue
+			}
+			if s.Type == "descending" && k1 != nil && k2 != nil {
+				c = -c
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// returns value of a filter as a string. Dates are {"start_date": ...}
+func filterValueString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		if val {
+			return "Yes"
+		}
+		return "No"
+	case map[string]interface{}:
+		s, _ := val["start_date"].(string)
+		return s
+	}
+	return ""
+}
+
+func containsFold(a []string, s string) bool {
+	for _, v := range a {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// number filters, called with value of the cell and of the filter
+	numberComparators = map[string]func(n, v float64) bool{
+		"number_equals":                   func(n, v float64) bool { return n == v },
+		"number_does_not_equal":           func(n, v float64) bool { return n != v },
+		"number_greater_than":             func(n, v float64) bool { return n > v },
+		"number_less_than":                func(n, v float64) bool { return n < v },
+		"number_greater_than_or_equal_to": func(n, v float64) bool { return n >= v },
+		"number_less_than_or_equal_to":    func(n, v float64) bool { return n <= v },
+	}
+	// date filters, called with result of comparing the date in the cell
+	// with the date of the filter
+	dateComparators = map[string]func(c int) bool{
+		"date_is":              func(c int) bool { return c == 0 },
+		"date_is_before":       func(c int) bool { return c < 0 },
+		"date_is_after":        func(c int) bool { return c > 0 },
+		"date_is_on_or_before": func(c int) bool { return c <= 0 },
+		"date_is_on_or_after":  func(c int) bool { return c >= 0 },
+	}
+)
+
+// returns false if comparator is not known
+func (t *collectionTable) matchFilter(row *notionapi.Block, f *viewFilter) (bool, bool) {
+	v := row.Properties[f.Property]
+	text := strings.ToLower(cellText(v))
+	value := strings.ToLower(filterValueString(f.Value))
+	switch f.Comparator {
+	case "is_empty":
+		return text == "", true
+	case "is_not_empty":
+		return text != "", true
+	case "string_is":
+		return text == value, true
+	case "string_is_not":
+		return text != value, true
+	case "string_contains":
+		return strings.Contains(text, value), true
+	case "string_does_not_contain":
+		return !strings.Contains(text, value), true
+	case "string_starts_with":
+		return strings.HasPrefix(text, value), true
+	case "string_ends_with":
+		return strings.HasSuffix(text, value), true
+	case "enum_is", "enum_contains":
+		return containsFold(cellOptions(v), value), true
+	case "enum_is_not", "enum_does_not_contain":
+		return !containsFold(cellOptions(v), value), true
+	case "checkbox_is":
+		return cellChecked(v) == (value == "yes" || value == "true"), true
+	case "checkbox_is_not":
+		return cellChecked(v) != (value == "yes" || value == "true"), true
+	}
+
+	if match, ok := numberComparators[f.Comparator]; ok {
+		n, ok1 := cellNumber(v)
+		fv, err := strconv.ParseFloat(value, 64)
+		if !ok1 || err != nil {
+			return false, true
+		}
+		return match(n, fv), true
+	}
+
+	if match, ok := dateComparators[f.Comparator]; ok {
+		d := cellDate(v)
+		if d == nil || value == "" {
+			return false, true
+		}
+		// dates are "2018-07-12" so they compare as strings
+		return match(strings.Compare(d.StartDate, value)), true
+	}
+	return true, false
+}
+
+func (t *collectionTable) filterRows(g *HTMLGenerator, block *notionapi.Block, q *viewQuery) {
+	if len(q.Filter) == 0 {
+		return
+	}
+	isOr := q.FilterOperator == "or"
+	var rows []*notionapi.Block
+	unsupported := map[string]bool{}
+	for _, row := range t.rows {
+		matches := !isOr
+		// row matches if none of the filters are supported
+		applied := false
+		for _, f := range q.Filter {
+			ok, known := t.matchFilter(row, f)
+			if !known {
+				if !unsupported[f.Comparator] {
+					g.report(SeverityInfo, block, "unsupported table filter '%s', ignoring", f.Comparator)
+					unsupported[f.Comparator] = true
+				}
+				continue
+			}
+			applied = true
+			if isOr {
+				matches = matches || ok
+			} else {
+				matches = matches && ok
+			}
+		}
+		if matches || !applied {
+			rows = append(rows, row)
+		}
+	}
+	t.rows = rows
+}
+
+// converts rich text of a cell to inline blocks so that it's rendered like
+// other inline content
+func (g *HTMLGenerator) cellInlineBlocks(v interface{}) []*notionapi.InlineBlock {
+	items, _ := v.([]interface{})
+	var res []*notionapi.InlineBlock
+	for _, item := range items {
+		parts, _ := item.([]interface{})
+		if len(parts) == 0 {
+			continue
+		}
+		text, _ := parts[0].(string)
+		b := &notionapi.InlineBlock{
+			Text: html.EscapeString(text),
+		}
+		var attrs []interface{}
+		if len(parts) > 1 {
+			attrs, _ = parts[1].([]interface{})
+		}
+		for _, attr := range attrs {
+			a, _ := attr.([]interface{})
+			if len(a) == 0 {
+				continue
+			}
+			name, _ := a[0].(string)
+			var val interface{}
+			if len(a) > 1 {
+				val = a[1]
+			}
+			switch name {
+			case "b":
+				b.AttrFlags |= notionapi.AttrBold
+			case "i":
+				b.AttrFlags |= notionapi.AttrItalic
+			case "s":
+				b.AttrFlags |= notionapi.AttrStrikeThrought
+			case "c":
+				b.AttrFlags |= notionapi.AttrCode
+			case "a":
+				b.Link, _ = val.(string)
+			case "u":
+				b.UserID, _ = val.(string)
+			case "d":
+				if d := cellDate([]interface{}{item}); d != nil {
+					b.Date = &notionapi.Date{StartDate: d.StartDate, Type: d.Type}
+					if g.dates == nil {
+						g.dates = map[*notionapi.Date]*notionDate{}
+					}
+					g.dates[b.Date] = d
+				}
+			}
+		}
+		res = append(res, b)
+	}
+	return res
+}
+
+var numberFormatCurrencies = map[string]string{
+	"dollar": "$",
+	"euro":   "€",
+	"pound":  "£",
+	"yen":    "¥",
+	"rupee":  "₹",
+	"won":    "₩",
+	"yuan":   "CN¥",
+}
+
+// "1234567.5" => "1,234,567.5"
+func numberWithCommas(s string) string {
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i:]
+	}
+	var buf bytes.Buffer
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteRune(c)
+	}
+	res := buf.String() + frac
+	if neg {
+		res = "-" + res
+	}
+	return res
+}
+
+func formatNumber(f float64, numberFormat string) string {
+	switch numberFormat {
+	case "number_with_commas":
+		return numberWithCommas(strconv.FormatFloat(f, 'f', -1, 64))
+	case "percent":
+		// round to 15 significant digits so that 0.07 is 7% and
+		// not 7.000000000000001%
+		p, _ := strconv.ParseFloat(strconv.FormatFloat(f*100, 'g', 15, 64), 64)
+		return strconv.FormatFloat(p, 'f', -1, 64) + "%"
+	}
+	if sym, ok := numberFormatCurrencies[numberFormat]; ok {
+		s := numberWithCommas(strconv.FormatFloat(f, 'f', 2, 64))
+		if strings.HasPrefix(s, "-") {
+			return "-" + sym + s[1:]
+		}
+		return sym + s
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatRowTime(ms int64) string {
+	return time.Unix(ms/1000, 0).UTC().Format("Jan 2, 2006 3:04 PM")
+}
+
+// returns html of a cell and its css class
+func (g *HTMLGenerator) cellHTML(t *collectionTable, row *notionapi.Block, property string) (string, string) {
+	v := row.Properties[property]
+	switch t.columnType(property) {
+	case "checkbox":
+		checked := ""
+		if cellChecked(v) {
+			checked = " checked"
+		}
+		return fmt.Sprintf(`<input type="checkbox" disabled%s>`, checked), "checkbox"
+	case "number":
+		f, ok := cellNumber(v)
+		if !ok {
+			return html.EscapeString(cellText(v)), "number"
+		}
+		numberFormat := ""
+		if cf := t.formats[property]; cf != nil {
+			numberFormat = cf.NumberFormat
+		}
+		return html.EscapeString(formatNumber(f, numberFormat)), "number"
+	case "select", "multi_select":
+		var a []string
+		for _, opt := range cellOptions(v) {
+			cls := "select"
+			if info := t.schema[property]; info != nil {
+				for _, o := range info.Options {
+					if o.Value == opt && o.Color != "" {
+						cls += " select-" + o.Color
+					}
+				}
+			}
+			a = append(a, fmt.Sprintf(`<span class="%s">%s</span>`, cls, html.EscapeString(opt)))
+		}
+		return strings.Join(a, " "), ""
+	case "url", "email", "phone_number":
+		s := strings.TrimSpace(cellText(v))
+		if s == "" {
+			return "", ""
+		}
+		uri := s
+		switch t.columnType(property) {
+		case "email":
+			uri = "mailto:" + s
+		case "phone_number":
+			uri = "tel:" + s
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(uri), html.EscapeString(s)), ""
+	case "date":
+		d := cellDate(v)
+		if d == nil {
+			return "", ""
+		}
+		s, err := formatNotionDate(d)
+		if err != nil {
+			g.report(SeverityWarning, nil, "invalid date '%s': %s", d.StartDate, err)
+			s = d.StartDate
+		}
+		return html.EscapeString(s), ""
+	case "created_time":
+		return formatRowTime(row.CreatedTime), ""
+	case "last_edited_time":
+		return formatRowTime(row.LastEditedTime), ""
+	}
+	// title, text, person etc. are rich text
+	return string(g.getInline(g.cellInlineBlocks(v))), ""
+}
+
+func (g *HTMLGenerator) genCollectionTable(block *notionapi.Block, t *collectionTable) {
+	s := `<table class="notion-table"><thead><tr>`
+	for _, col := range t.columns {
+		colName := col.Property
+		colInfo := t.schema[colName]
+		name := ""
+		if colInfo != nil {
+			name = colInfo.Name
+		} else {
+			g.report(SeverityWarning, block, "missing info for table column '%s'", colName)
+		}
+		s += `<th>` + html.EscapeString(name) + `</th>`
+	}
+	s += `</tr></thead>`
+	s += `<tbody>`
+	for _, row := range t.rows {
+		s += `<tr>`
+		for _, col := range t.columns {
+			cell, cls := g.cellHTML(t, row, col.Property)
+			td := `<td>`
+			if cls != "" {
+				td = fmt.Sprintf(`<td class="%s">`, cls)
+			}
+			if cell == "" {
+				// use &nbsp; so that empty row still shows up
+				// could also set a min-height to 1em or sth. like that
+				cell = `&nbsp;`
+			}
+			s += td + cell + `</td>`
+		}
+		s += `</tr>`
+	}
+	s += `</tbody>`
+	s += `</table>`
+	g.writeString(s)
+}
+
+// genCollectionView renders all views of a collection as tables. Other
+// view types (board, list, gallery etc.) are also shown as tables
+func (g *HTMLGenerator) genCollectionView(block *notionapi.Block) {
+	if len(block.CollectionViews) == 0 {
+		g.report(SeverityWarning, block, "collection view without views")
+		return
+	}
+	if !g.rawRecordsLoaded {
+		g.rawRecords = loadNotionRawRecords(g.book, g.page.NotionID)
+		g.rawRecordsLoaded = true
+	}
+	showNames := len(block.CollectionViews) > 1
+	for _, viewInfo := range block.CollectionViews {
+		view := viewInfo.CollectionView
+		t := &collectionTable{
+			viewInfo: viewInfo,
+			schema:   viewInfo.Collection.CollectionSchema,
+			formats:  g.rawRecords.columnFormats(viewInfo.Collection.ID),
+			rows:     append([]*notionapi.Block{}, viewInfo.CollectionRows...),
+		}
+		if view.Format != nil {
+			for _, col := range view.Format.TableProperties {
+				if col.Visible {
+					t.columns = append(t.columns, col)
+				}
+			}
+		}
+		if q := g.rawRecords.viewQuery(view.ID); q != nil {
+			t.filterRows(g, block, q)
+			t.sortRows(q.Sort)
+		}
+		if showNames {
+			fmt.Fprintf(g.f, `<div class="collection-view-name">%s</div>`, html.EscapeString(view.Name))
+		}
+		g.genCollectionTable(block, t)
+	}
+}
+
+// page json in the cache and raw records are both inputs of the page
+func readNotionRawRecordsFile(b *Book, pageID string) []byte {
+	d, err := ioutil.ReadFile(notionRecordsPath(b, pageID))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("readNotionRawRecordsFile: '%s'\n", err)
+	}
+	return d
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kjk/notionapi"
+)
+
+// cell with plain text, as in notion's raw properties
+func textCell(s string) interface{} {
+	return []interface{}{[]interface{}{s}}
+}
+
+func dateCell(startDate string) interface{} {
+	date := map[string]interface{}{"type": "date", "start_date": startDate}
+	return []interface{}{[]interface{}{"‣", []interface{}{[]interface{}{"d", date}}}}
+}
+
+// table with columns name (text), n (number), done (checkbox),
+// tags (multi_select) and on (date)
+func newTestCollectionTable(rows ...map[string]interface{}) *collectionTable {
+	t := &collectionTable{
+		schema: map[string]*notionapi.CollectionColumnInfo{
+			"name": {Type: "title"},
+			"n":    {Type: "number"},
+			"done": {Type: "checkbox"},
+			"tags": {Type: "multi_select"},
+			"on":   {Type: "date"},
+		},
+	}
+	for _, props := range rows {
+		t.rows = append(t.rows, &notionapi.Block{Properties: props})
+	}
+	return t
+}
+
+func rowNames(t *collectionTable) string {
+	var a []string
+	for _, row := range t.rows {
+		a = append(a, cellText(row.Properties["name"]))
+	}
+	return strings.Join(a, ",")
+}
+
+func TestMatchFilter(t *testing.T) {
+	table := newTestCollectionTable()
+	row := &notionapi.Block{
+		Properties: map[string]interface{}{
+			"name": textCell("Hello World"),
+			"n":    textCell("-2.5"),
+			"done": textCell("Yes"),
+			"tags": textCell("go,Rust"),
+			"on":   dateCell("2018-07-12"),
+		},
+	}
+	tests := []struct {
+		property   string
+		comparator string
+		value      interface{}
+		exp        bool
+		known      bool
+	}{
+		{"name", "string_is", "hello world", true, true},
+		{"name", "string_is_not", "Hello World", false, true},
+		{"name", "string_contains", "WORLD", true, true},
+		{"name", "string_does_not_contain", "foo", true, true},
+		{"name", "string_starts_with", "hello", true, true},
+		{"name", "string_ends_with", "hello", false, true},
+		{"name", "is_empty", nil, false, true},
+		{"missing", "is_empty", nil, true, true},
+		{"missing", "is_not_empty", nil, false, true},
+		{"tags", "enum_contains", "rust", true, true},
+		{"tags", "enum_is", "ru", false, true},
+		{"tags", "enum_does_not_contain", "go", false, true},
+		{"done", "checkbox_is", true, true, true},
+		{"done", "checkbox_is", "No", false, true},
+		{"done", "checkbox_is_not", false, true, true},
+		{"missing", "checkbox_is", false, true, true},
+		{"n", "number_equals", -2.5, true, true},
+		{"n", "number_less_than", float64(0), true, true},
+		{"n", "number_greater_than", "-3", true, true},
+		{"n", "number_greater_than_or_equal_to", -2.5, true, true},
+		{"n", "number_less_than_or_equal_to", float64(-3), false, true},
+		// empty cell doesn't match any number filter
+		{"missing", "number_does_not_equal", float64(1), false, true},
+		{"on", "date_is", map[string]interface{}{"start_date": "2018-07-12"}, true, true},
+		{"on", "date_is_before", map[string]interface{}{"start_date": "2018-07-13"}, true, true},
+		{"on", "date_is_after", map[string]interface{}{"start_date": "2018-07-13"}, false, true},
+		{"on", "date_is_on_or_after", map[string]interface{}{"start_date": "2018-07-12"}, true, true},
+		{"missing", "date_is_on_or_before", map[string]interface{}{"start_date": "2018-07-12"}, false, true},
+		{"name", "string_matches_regexp", "x", true, false},
+		{"n", "number_is_prime", float64(2), true, false},
+		{"on", "date_is_within", "past_week", true, false},
+	}
+	for _, test := range tests {
+		f := &viewFilter{Property: test.property, Comparator: test.comparator, Value: test.value}
+		got, known := table.matchFilter(row, f)
+		if got != test.exp || known != test.known {
+			t.Errorf("matchFilter(%s %s %v) = %v, %v, expected %v, %v", test.property, test.comparator, test.value, got, known, test.exp, test.known)
+		}
+	}
+}
+
+func TestFilterRows(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"name": textCell("a"), "n": textCell("1")},
+		{"name": textCell("b"), "n": textCell("5")},
+		{"name": textCell("c"), "n": textCell("10")},
+		{"name": textCell("d")},
+	}
+	unknown := &viewFilter{Property: "n", Comparator: "number_is_prime"}
+	tests := []struct {
+		operator string
+		filters  []*viewFilter
+		exp      string
+	}{
+		{"and", []*viewFilter{
+			{Property: "n", Comparator: "number_greater_than", Value: float64(1)},
+			{Property: "n", Comparator: "number_less_than", Value: float64(10)},
+		}, "b"},
+		{"or", []*viewFilter{
+			{Property: "n", Comparator: "number_less_than", Value: float64(2)},
+			{Property: "n", Comparator: "is_empty"},
+		}, "a,d"},
+		// unknown comparators are ignored
+		{"and", []*viewFilter{
+			{Property: "name", Comparator: "string_is_not", Value: "a"},
+			unknown,
+		}, "b,c,d"},
+		{"or", []*viewFilter{
+			unknown,
+			{Property: "name", Comparator: "string_is", Value: "c"},
+		}, "c"},
+		// if no filter is known, all rows match
+		{"or", []*viewFilter{unknown}, "a,b,c,d"},
+		{"and", []*viewFilter{unknown}, "a,b,c,d"},
+		{"and", nil, "a,b,c,d"},
+	}
+	defer clearDiagnostics()
+	for _, test := range tests {
+		table := newTestCollectionTable(rows...)
+		g := &HTMLGenerator{book: &Book{Dir: "test"}, page: &Page{}}
+		q := &viewQuery{Filter: test.filters, FilterOperator: test.operator}
+		table.filterRows(g, nil, q)
+		if got := rowNames(table); got != test.exp {
+			t.Errorf("%s filter %d: got rows %q, expected %q", test.operator, len(test.filters), got, test.exp)
+		}
+	}
+}
+
+func TestCompareSortKeys(t *testing.T) {
+	tests := []struct {
+		k1, k2 interface{}
+		exp    int
+	}{
+		{nil, nil, 0},
+		{nil, float64(1), 1},
+		{"a", nil, -1},
+		{float64(-1), float64(2), -1},
+		{float64(2.5), float64(2.5), 0},
+		{float64(3), float64(2.5), 1},
+		{false, true, -1},
+		{true, false, 1},
+		{true, true, 0},
+		{"a", "b", -1},
+		{"b", "a", 1},
+	}
+	for _, test := range tests {
+		if got := compareSortKeys(test.k1, test.k2); got != test.exp {
+			t.Errorf("compareSortKeys(%v, %v) = %d, expected %d", test.k1, test.k2, got, test.exp)
+		}
+	}
+}
+
+func TestSortRows(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"name": textCell("b"), "n": textCell("10"), "done": textCell("Yes")},
+		{"name": textCell("")},
+		{"name": textCell("C"), "n": textCell("-1.5"), "done": textCell("Yes")},
+		{"name": textCell("a"), "n": textCell("2")},
+	}
+	tests := []struct {
+		sorts []*viewSort
+		exp   string
+	}{
+		{nil, "b,,C,a"},
+		// strings are compared ignoring case
+		{[]*viewSort{{Property: "name", Type: "ascending"}}, "a,b,C,"},
+		// empty cells are last in both directions
+		{[]*viewSort{{Property: "name", Type: "descending"}}, "C,b,a,"},
+		// numbers are compared as numbers, not strings
+		{[]*viewSort{{Property: "n", Type: "ascending"}}, "C,a,b,"},
+		{[]*viewSort{{Property: "n", Type: "descending"}}, "b,a,C,"},
+		// second sort decides when the first is equal. Unchecked
+		// checkbox is not empty
+		{[]*viewSort{{Property: "done", Type: "descending"}, {Property: "name", Type: "ascending"}}, "b,C,a,"},
+	}
+	for _, test := range tests {
+		table := newTestCollectionTable(rows...)
+		table.sortRows(test.sorts)
+		if got := rowNames(table); got != test.exp {
+			t.Errorf("sortRows(%d sorts) got rows %q, expected %q", len(test.sorts), got, test.exp)
+		}
+	}
+}
+
+func TestNumberWithCommas(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp string
+	}{
+		{"0", "0"},
+		{"123", "123"},
+		{"1234", "1,234"},
+		{"123456", "123,456"},
+		{"1234567.5", "1,234,567.5"},
+		{"-1234", "-1,234"},
+		{"-123", "-123"},
+		{"-123456.789", "-123,456.789"},
+		{"0.12345", "0.12345"},
+	}
+	for _, test := range tests {
+		if got := numberWithCommas(test.s); got != test.exp {
+			t.Errorf("numberWithCommas(%q) = %q, expected %q", test.s, got, test.exp)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := []struct {
+		f      float64
+		format string
+		exp    string
+	}{
+		{1234.5, "", "1234.5"},
+		{1234.5, "number", "1234.5"},
+		{-1234567, "number_with_commas", "-1,234,567"},
+		{1234.125, "number_with_commas", "1,234.125"},
+		{0.25, "percent", "25%"},
+		{-0.5, "percent", "-50%"},
+		{0.07, "percent", "7%"},
+		{1234.5, "dollar", "$1,234.50"},
+		{-1234.5, "dollar", "-$1,234.50"},
+		{0.005, "euro", "€0.01"},
+		{-0.5, "pound", "-£0.50"},
+		{1000000, "yuan", "CN¥1,000,000.00"},
+		{12, "unknown_format", "12"},
+	}
+	for _, test := range tests {
+		if got := formatNumber(test.f, test.format); got != test.exp {
+			t.Errorf("formatNumber(%v, %q) = %q, expected %q", test.f, test.format, got, test.exp)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kjk/notionapi"
+)
+
+/*
+Downloading a book from notion means downloading 300+ pages. We download
+them in parallel, with a limit on number of requests per second so that we
+don't get throttled by notion, and retry failed downloads with exponential
+backoff.
+
+When we download without cache (-no-cache), we record ids of downloaded
+pages in a crawl state file. If the crawl is interrupted, the next crawl
+takes those pages from the cache and only downloads the rest. The state
+file is deleted when crawl finishes.
+*/
+
+// NotionDownloader controls how we download pages from notion
+type NotionDownloader struct {
+	// number of pages downloaded in parallel
+	Workers int
+	// max number of http requests per second, 0 means no limit
+	RequestsPerSecond float64
+	// max number of download attempts of a single page
+	MaxTries int
+	// first retry is after this time, doubles with each retry
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+var (
+	notionDownloader = &NotionDownloader{
+		Workers:           4,
+		RequestsPerSecond: 4,
+		MaxTries:          6,
+		RetryDelay:        time.Second,
+		MaxRetryDelay:     30 * time.Second,
+	}
+)
+
+// rateLimiter allows at most one event per interval
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	res := &rateLimiter{}
+	if perSecond > 0 {
+		res.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return res
+}
+
+// Wait blocks until the next event is allowed
+func (l *rateLimiter) Wait() {
+	if l.interval == 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// rateLimitedTransport is http.RoundTripper that limits the rate of requests
+type rateLimitedTransport struct {
+	limiter *rateLimiter
+	base    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.limiter.Wait()
+	return t.base.RoundTrip(r)
+}
+
+// newNotionClient returns notion client whose requests are rate limited
+func newNotionClient() *notionapi.Client {
+	transport := &rateLimitedTransport{
+		limiter: newRateLimiter(notionDownloader.RequestsPerSecond),
+		base:    http.DefaultTransport,
+	}
+	return &notionapi.Client{
+		HTTPClient: &http.Client{
+			Transport: transport,
+			Timeout:   time.Minute,
+		},
+	}
+}
+
+// returns time to wait before retry number n (starting with 1), with jitter
+// so that workers don't retry at the same time
+func (d *NotionDownloader) retryDelay(n int) time.Duration {
+	delay := d.RetryDelay << uint(n-1)
+	if delay > d.MaxRetryDelay || delay <= 0 {
+		delay = d.MaxRetryDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay/2 + jitter
+}
+
+// notionCrawlState records pages downloaded in current crawl of a book
+type notionCrawlState struct {
+	StartPageID string
+	Downloaded  []string
+
+	path string
+	mu   sync.Mutex
+}
+
+func crawlStatePath(b *Book) string {
+	return filepath.Join(notionLogDir, "notion_crawl_"+b.Dir+".json")
+}
+
+// loads state of interrupted crawl or starts a new one
+func loadNotionCrawlState(b *Book, startPageID string) *notionCrawlState {
+	path := crawlStatePath(b)
+	res := &notionCrawlState{}
+	d, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(d, res)
+		if err != nil {
+			fmt.Printf("loadNotionCrawlState: json.Unmarshal('%s') failed with '%s'\n", path, err)
+		}
+	}
+	if err != nil || res.StartPageID != startPageID {
+		res = &notionCrawlState{
+			StartPageID: startPageID,
+		}
+	}
+	res.path = path
+	if len(res.Downloaded) > 0 {
+		fmt.Printf("Resuming crawl of book %s, %d pages already downloaded\n", b.Title, len(res.Downloaded))
+	}
+	return res
+}
+
+// returns pages downloaded in interrupted crawl
+func (s *notionCrawlState) downloadedPages() map[string]bool {
+	res := map[string]bool{}
+	for _, id := range s.Downloaded {
+		res[id] = true
+	}
+	return res
+}
+
+func (s *notionCrawlState) addDownloaded(pageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Downloaded = append(s.Downloaded, pageID)
+	d, err := json.Marshal(s)
+	panicIfErr(err)
+	err = writeFileAtomic(s.path, d)
+	if err != nil {
+		// not fatal, we just won't be able to resume
+		fmt.Printf("Saving crawl state to '%s' failed with '%s'\n", s.path, err)
+	}
+}
+
+func (s *notionCrawlState) finish() {
+	err := os.Remove(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("os.Remove('%s') failed with '%s'\n", s.path, err)
+	}
+}
+
+type notionCrawlResult struct {
+	pageID    string
+	page      *notionapi.Page
+	fromCache bool
+	err       error
+}
+
+// crawlNotionPages loads the page with startPageID and all its sub-pages,
+// recursively, using notionDownloader.Workers workers
+func crawlNotionPages(b *Book, c *notionapi.Client, startPageID string, idToPage map[string]*notionapi.Page, useCache bool) {
+	startPageID = normalizeID(startPageID)
+	var state *notionCrawlState
+	var fromPrevCrawl map[string]bool
+	if !useCache {
+		state = loadNotionCrawlState(b, startPageID)
+		fromPrevCrawl = state.downloadedPages()
+	}
+
+	jobs := make(chan string)
+	results := make(chan *notionCrawlResult)
+	nWorkers := notionDownloader.Workers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			for pageID := range jobs {
+				res := &notionCrawlResult{
+					pageID: pageID,
+				}
+				getFromCache := useCache || fromPrevCrawl[pageID]
+				if getFromCache {
+					res.page = loadPageFromCache(b, pageID)
+					res.fromCache = res.page != nil
+				}
+				if res.page == nil {
+					res.page, res.err = downloadAndCachePage(b, c, pageID)
+					if res.err == nil && state != nil {
+						state.addDownloaded(pageID)
+					}
+				}
+				results <- res
+			}
+		}()
+	}
+
+	seen := map[string]bool{}
+	var toVisit []string
+	for id := range idToPage {
+		seen[id] = true
+	}
+	if !seen[startPageID] {
+		seen[startPageID] = true
+		toVisit = append(toVisit, startPageID)
+	}
+
+	var firstErr error
+	nInFlight := 0
+	n := 1
+	for len(toVisit) > 0 || nInFlight > 0 {
+		var sendCh chan string
+		var next string
+		// stop scheduling new downloads after first error
+		if len(toVisit) > 0 && firstErr == nil {
+			sendCh = jobs
+			next = toVisit[0]
+		} else if nInFlight == 0 {
+			break
+		}
+		select {
+		case sendCh <- next:
+			toVisit = toVisit[1:]
+			nInFlight++
+		case res := <-results:
+			nInFlight--
+			if res.err != nil {
+				fmt.Printf("Downloading page %s failed with '%s'\n", res.pageID, res.err)
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				continue
+			}
+			page := res.page
+			if res.fromCache {
+				nNotionPagesFromCache++
+			} else {
+				fmt.Printf("Downloaded %d %s %s\n", n, page.ID, page.Root.Title)
+			}
+			n++
+			idToPage[res.pageID] = page
+			for _, id := range findSubPageIDs(page.Root.Content) {
+				if !seen[id] {
+					seen[id] = true
+					toVisit = append(toVisit, id)
+				}
+			}
+		}
+	}
+	close(jobs)
+	// crawl state is kept so that we can resume
+	panicIfErr(firstErr)
+	if state != nil {
+		state.finish()
+	}
+}
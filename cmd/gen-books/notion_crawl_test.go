@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kjk/notionapi"
+)
+
+// fakeNotion is a stand-in for notion api that serves a tree of pages
+type fakeNotion struct {
+	mu sync.Mutex
+	// maps id of a page to ids of its sub-pages
+	children map[string][]string
+	// number of loadPageChunk requests for a page
+	chunkRequests map[string]int
+	// status codes returned for the next loadPageChunk requests for a page
+	failures map[string][]int
+}
+
+func newFakeNotion(children map[string][]string) *fakeNotion {
+	return &fakeNotion{
+		children:      children,
+		chunkRequests: map[string]int{},
+		failures:      map[string][]int{},
+	}
+}
+
+func (f *fakeNotion) pageBlock(id string) *notionapi.Block {
+	dashID, _ := notionapi.NormalizeID(id)
+	var contentIDs []string
+	for _, childID := range f.children[id] {
+		dashChildID, _ := notionapi.NormalizeID(childID)
+		contentIDs = append(contentIDs, dashChildID)
+	}
+	return &notionapi.Block{
+		ID:          dashID,
+		Type:        notionapi.BlockPage,
+		Alive:       true,
+		ContentIDs:  contentIDs,
+		ParentTable: "block",
+		Properties: map[string]interface{}{
+			"title": []interface{}{[]interface{}{"Page " + id[:4]}},
+		},
+	}
+}
+
+func (f *fakeNotion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PageID   string `json:"pageId"`
+		Requests []struct {
+			ID string `json:"id"`
+		} `json:"requests"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rsp interface{}
+	switch r.URL.Path {
+	case "/api/v3/getRecordValues":
+		var results []*notionapi.BlockWithRole
+		for _, rr := range req.Requests {
+			results = append(results, &notionapi.BlockWithRole{Role: "reader", Value: f.pageBlock(normalizeID(rr.ID))})
+		}
+		rsp = &notionapi.GetRecordValuesResponse{Results: results}
+	case "/api/v3/loadPageChunk":
+		id := normalizeID(req.PageID)
+		f.mu.Lock()
+		f.chunkRequests[id]++
+		code := 0
+		if a := f.failures[id]; len(a) > 0 {
+			code, f.failures[id] = a[0], a[1:]
+		}
+		f.mu.Unlock()
+		if code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		blocks := map[string]*notionapi.BlockWithRole{}
+		for _, blockID := range append([]string{id}, f.children[id]...) {
+			b := f.pageBlock(blockID)
+			if blockID != id {
+				// sub-pages are loaded with their own loadPageChunk
+				b.ContentIDs = nil
+			}
+			blocks[b.ID] = &notionapi.BlockWithRole{Role: "reader", Value: b}
+		}
+		rsp = map[string]interface{}{
+			"recordMap": map[string]interface{}{"block": blocks},
+			"cursor":    map[string]interface{}{"stack": []interface{}{}},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func (f *fakeNotion) requestsFor(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.chunkRequests[id]
+}
+
+// redirectTransport sends all requests to the test server
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+const (
+	testRootID = "10000000000000000000000000000001"
+	testPageA  = "20000000000000000000000000000002"
+	testPageB  = "30000000000000000000000000000003"
+	testPageC  = "40000000000000000000000000000004"
+)
+
+func testPageTree() map[string][]string {
+	return map[string][]string{
+		testRootID: {testPageA, testPageB},
+		testPageA:  {testPageC},
+	}
+}
+
+// runs the test in a temporary directory with notion client talking
+// to fake notion server
+func setupCrawlTest(t *testing.T, fake *fakeNotion) (*Book, *notionapi.Client) {
+	dir, err := ioutil.TempDir("", "notion_crawl_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(fake)
+	prevDownloader := *notionDownloader
+	notionDownloader.Workers = 3
+	notionDownloader.MaxTries = 4
+	notionDownloader.RetryDelay = 10 * time.Millisecond
+	notionDownloader.MaxRetryDelay = 40 * time.Millisecond
+	nNotionPagesFromCache = 0
+	t.Cleanup(func() {
+		srv.Close()
+		*notionDownloader = prevDownloader
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+
+	book := &Book{Dir: "test", Title: "Test"}
+	createDirMust(notionLogDir)
+	createDirMust(book.NotionCacheDir())
+	target, _ := url.Parse(srv.URL)
+	c := &notionapi.Client{
+		HTTPClient: &http.Client{Transport: &redirectTransport{target: target}},
+	}
+	return book, c
+}
+
+func sortedKeys(m map[string]*notionapi.Page) []string {
+	var res []string
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestCrawlNotionPages(t *testing.T) {
+	fake := newFakeNotion(testPageTree())
+	book, c := setupCrawlTest(t, fake)
+
+	idToPage := map[string]*notionapi.Page{}
+	crawlNotionPages(book, c, testRootID, idToPage, false)
+
+	got := sortedKeys(idToPage)
+	exp := []string{testRootID, testPageA, testPageB, testPageC}
+	if len(got) != len(exp) {
+		t.Fatalf("got pages %v, expected %v", got, exp)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("got pages %v, expected %v", got, exp)
+		}
+	}
+	for _, id := range exp {
+		if n := fake.requestsFor(id); n != 1 {
+			t.Errorf("page %s downloaded %d times, expected once", id, n)
+		}
+		if loadPageFromCache(book, id) == nil {
+			t.Errorf("page %s is not in the cache", id)
+		}
+	}
+	if pathExists(crawlStatePath(book)) {
+		t.Errorf("crawl state '%s' should be deleted after finished crawl", crawlStatePath(book))
+	}
+}
+
+func TestCrawlRetriesWithBackoff(t *testing.T) {
+	fake := newFakeNotion(testPageTree())
+	fake.failures[testPageB] = []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	book, c := setupCrawlTest(t, fake)
+
+	timeStart := time.Now()
+	idToPage := map[string]*notionapi.Page{}
+	crawlNotionPages(book, c, testRootID, idToPage, false)
+	dur := time.Since(timeStart)
+
+	if idToPage[testPageB] == nil {
+		t.Fatalf("page %s should be downloaded after retries", testPageB)
+	}
+	if n := fake.requestsFor(testPageB); n != 4 {
+		t.Errorf("page %s requested %d times, expected 4", testPageB, n)
+	}
+	// retries wait at least half of 10ms, 20ms and 40ms
+	if minDur := 35 * time.Millisecond; dur < minDur {
+		t.Errorf("crawl took %s, expected at least %s of backoff", dur, minDur)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := &NotionDownloader{
+		RetryDelay:    100 * time.Millisecond,
+		MaxRetryDelay: time.Second,
+	}
+	tests := []struct {
+		n   int
+		max time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		// capped by MaxRetryDelay
+		{5, time.Second},
+		{40, time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			got := d.retryDelay(test.n)
+			if got < test.max/2 || got > test.max {
+				t.Fatalf("retryDelay(%d) = %s, expected between %s and %s", test.n, got, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestCrawlResumesInterruptedCrawl(t *testing.T) {
+	fake := newFakeNotion(testPageTree())
+	// page c fails more times than we try so the crawl is interrupted
+	fake.failures[testPageC] = []int{500, 500, 500, 500}
+	book, c := setupCrawlTest(t, fake)
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected crawl to fail")
+			}
+		}()
+		crawlNotionPages(book, c, testRootID, map[string]*notionapi.Page{}, false)
+	}()
+
+	d, err := ioutil.ReadFile(crawlStatePath(book))
+	if err != nil {
+		t.Fatalf("crawl state not saved: %s", err)
+	}
+	var state notionCrawlState
+	if err = json.Unmarshal(d, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.StartPageID != testRootID || len(state.Downloaded) != 3 {
+		t.Fatalf("unexpected crawl state %s", string(d))
+	}
+
+	idToPage := map[string]*notionapi.Page{}
+	crawlNotionPages(book, c, testRootID, idToPage, false)
+	if len(idToPage) != 4 {
+		t.Fatalf("got %d pages, expected 4", len(idToPage))
+	}
+	// pages downloaded before interruption come from the cache
+	for _, id := range []string{testRootID, testPageA, testPageB} {
+		if n := fake.requestsFor(id); n != 1 {
+			t.Errorf("page %s downloaded %d times, expected once", id, n)
+		}
+	}
+	if n := fake.requestsFor(testPageC); n != 5 {
+		t.Errorf("page %s requested %d times, expected 5", testPageC, n)
+	}
+	if nNotionPagesFromCache != 3 {
+		t.Errorf("got %d pages from cache, expected 3", nNotionPagesFromCache)
+	}
+	if pathExists(crawlStatePath(book)) {
+		t.Errorf("crawl state should be deleted after finished crawl")
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/template"
+	"github.com/kjk/notionapi"
+	"github.com/kjk/u"
+)
+
+/*
+Images in notion pages point to notion's S3 urls which expire, so we host
+them ourselves.
+
+During notion download step we download images of each page to
+cache/${book}/images. The name of the file is a hash of image's url so that
+we can find it without an index. Pages loaded from notion cache don't
+download images, -download-images downloads missing images of those pages.
+
+When generating html, the image is written to www/essential/${book}/img
+under a name with hash of its content. Images wider than the smallest
+variant also get smaller variants, in the original format (png or jpeg)
+and as webp if cwebp is installed, used in srcset. Variants are cached in
+cache/${book}/images/variants so that we only create them once.
+
+Images that are not in the cache (e.g. because download failed) are shown
+from notion's url.
+*/
+
+var (
+	// widths of smaller variants of images
+	imageVariantWidths = []int{320, 640, 960, 1280}
+	// max width of image in an article, used in sizes attribute
+	maxArticleImageWidth = 800
+
+	imageHTTPClient = &http.Client{
+		Timeout: time.Minute,
+	}
+
+	cwebpOnce        sync.Once
+	cwebpIsAvailable bool
+)
+
+// bookImage is an image processed for including in html
+type bookImage struct {
+	once sync.Once
+	err  error
+
+	// url of the image
+	URL    string
+	Width  int
+	Height int
+	// original and smaller variants in the same format
+	Srcset []imageVariant
+	// webp variants, empty if cwebp is not installed
+	WebP []imageVariant
+	// paths of files written to www
+	files []string
+}
+
+type imageVariant struct {
+	URL   string
+	Width int
+}
+
+func isCwebpAvailable() bool {
+	cwebpOnce.Do(func() {
+		_, err := exec.LookPath("cwebp")
+		cwebpIsAvailable = err == nil
+		if !cwebpIsAvailable {
+			fmt.Printf("'cwebp' not found, will not create webp images\n")
+		}
+	})
+	return cwebpIsAvailable
+}
+
+// returns url that identifies the image and urls to download it from,
+// most reliable first. Notion's proxy can access images in S3 which
+// are not accessible directly
+func getImageURLs(block *notionapi.Block) (string, []string) {
+	key := block.Source
+	if key == "" && block.FormatImage != nil {
+		key = block.FormatImage.DisplaySource
+	}
+	var urls []string
+	for _, uri := range []string{block.ImageURL, key} {
+		if uri != "" && (len(urls) == 0 || urls[0] != uri) {
+			urls = append(urls, uri)
+		}
+	}
+	return key, urls
+}
+
+func findImageBlocks(block *notionapi.Block) []*notionapi.Block {
+	var res []*notionapi.Block
+	if block == nil {
+		return nil
+	}
+	if block.Type == notionapi.BlockImage {
+		res = append(res, block)
+	}
+	for _, child := range block.Content {
+		res = append(res, findImageBlocks(child)...)
+	}
+	return res
+}
+
+// returns path of the cached image without extension
+func imageCachePathBase(b *Book, key string) string {
+	return filepath.Join(b.ImagesCacheDir(), u.Sha1HexOfBytes([]byte(key))[:16])
+}
+
+// returns path of the cached image or empty string if not cached
+func findCachedImage(b *Book, key string) string {
+	paths, _ := filepath.Glob(imageCachePathBase(b, key) + ".*")
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".tmp") {
+			return path
+		}
+	}
+	return ""
+}
+
+func imageExtFromContentType(contentType string, d []byte, uri string) string {
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(d)
+	}
+	switch strings.Split(contentType, ";")[0] {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/svg+xml":
+		return ".svg"
+	}
+	ext := strings.ToLower(filepath.Ext(fileNameFromURL(uri)))
+	switch ext {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".svg":
+		return ext
+	}
+	return ""
+}
+
+func httpGetImage(uri string) ([]byte, string, error) {
+	rsp, err := imageHTTPClient.Get(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("http status %d", rsp.StatusCode)
+	}
+	d, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	ext := imageExtFromContentType(rsp.Header.Get("Content-Type"), d, uri)
+	if ext == "" {
+		return nil, "", fmt.Errorf("not an image, Content-Type: '%s'", rsp.Header.Get("Content-Type"))
+	}
+	return d, ext, nil
+}
+
+// downloads the image from the first url that works
+func downloadImage(b *Book, key string, urls []string) error {
+	var err error
+	for _, uri := range urls {
+		var d []byte
+		var ext string
+		d, ext, err = httpGetImage(uri)
+		if err != nil {
+			continue
+		}
+		path := imageCachePathBase(b, key) + ext
+		createDirForFileMaybeMust(path)
+		return writeFileAtomic(path, d)
+	}
+	return err
+}
+
+// downloadPageImages downloads images of the page that are not yet cached
+func downloadPageImages(b *Book, page *notionapi.Page) {
+	for _, block := range findImageBlocks(page.Root) {
+		key, urls := getImageURLs(block)
+		if key == "" || findCachedImage(b, key) != "" {
+			continue
+		}
+		err := downloadImage(b, key, urls)
+		if err != nil {
+			p := &Page{
+				NotionID: normalizeID(page.ID),
+				Title:    page.Root.Title,
+			}
+			reportPage(SeverityWarning, b, p, block.ID, "downloading image '%s' failed with '%s'", key, err)
+			continue
+		}
+		fmt.Printf("Downloaded image %s\n", key)
+	}
+}
+
+// resizeImage scales down img to width w, averaging pixels that are
+// scaled into one
+func resizeImage(img image.Image, w int) image.Image {
+	sb := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(src, src.Bounds(), img, sb.Min, draw.Src)
+	sw, sh := sb.Dx(), sb.Dy()
+	h := (sh*w + sw/2) / sw
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := (y + 1) * sh / h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := (x + 1) * sw / w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[off])
+					g += int(src.Pix[off+1])
+					b += int(src.Pix[off+2])
+					a += int(src.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(b / n)
+			dst.Pix[off+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func encodeImage(img image.Image, ext string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if ext == ".jpg" || ext == ".jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// returns variant from the cache or creates it with create()
+func getImageVariant(b *Book, name string, create func(path string) error) ([]byte, error) {
+	path := filepath.Join(b.ImagesCacheDir(), "variants", name)
+	d, err := ioutil.ReadFile(path)
+	if err == nil {
+		return d, nil
+	}
+	createDirForFileMaybeMust(path)
+	tmpPath := path + ".tmp"
+	err = create(tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func cwebp(dst, src string, w int) error {
+	args := []string{"-quiet", "-q", "80"}
+	if w > 0 {
+		args = append(args, "-resize", fmt.Sprintf("%d", w), "0")
+	}
+	args = append(args, src, "-o", dst)
+	out, err := exec.Command("cwebp", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cwebp failed with '%s', output: '%s'", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (img *bookImage) addFile(b *Book, name string, d []byte) string {
+	path := filepath.Join(b.destDir(), "img", name)
+	img.files = append(img.files, path)
+	writeOutputFileMaybeMust(path, d)
+	return filepath.ToSlash(path[len(destDir):])
+}
+
+// returns name of the image in www e.g. "context-tree-ab12cd34.png"
+func imageWwwName(key string, ext string, sha1Hex string) string {
+	name := fileNameFromURL(key)
+	name = urlify(strings.TrimSuffix(name, filepath.Ext(name)))
+	if name == "" {
+		name = "image"
+	}
+	return nameToSha1Name(name+ext, sha1Hex)
+}
+
+func (img *bookImage) process(b *Book, key string, cachedPath string) error {
+	d, err := ioutil.ReadFile(cachedPath)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(cachedPath))
+	sha1Hex := u.Sha1HexOfBytes(d)
+	name := imageWwwName(key, ext, sha1Hex)
+	img.URL = img.addFile(b, name, d)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(d))
+	if err != nil {
+		// e.g. svg, we can't get its size but can still show it
+		return nil
+	}
+	img.Width = cfg.Width
+	img.Height = cfg.Height
+
+	// gif can be animated and we don't decode webp
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return nil
+	}
+	var decoded image.Image
+	nameBase := strings.TrimSuffix(name, ext)
+	for _, w := range imageVariantWidths {
+		if w >= img.Width {
+			break
+		}
+		variantName := fmt.Sprintf("%s-%dw%s", nameBase, w, ext)
+		vd, err := getImageVariant(b, variantName, func(path string) error {
+			if decoded == nil {
+				var err error
+				decoded, _, err = image.Decode(bytes.NewReader(d))
+				if err != nil {
+					return err
+				}
+			}
+			vd, err := encodeImage(resizeImage(decoded, w), ext)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, vd, 0644)
+		})
+		if err != nil {
+			return err
+		}
+		uri := img.addFile(b, variantName, vd)
+		img.Srcset = append(img.Srcset, imageVariant{URL: uri, Width: w})
+	}
+	if len(img.Srcset) > 0 {
+		img.Srcset = append(img.Srcset, imageVariant{URL: img.URL, Width: img.Width})
+	}
+
+	if !isCwebpAvailable() {
+		return nil
+	}
+	widths := append([]int{}, imageVariantWidths...)
+	widths = append(widths, 0)
+	for _, w := range widths {
+		if w >= img.Width {
+			continue
+		}
+		variantName := nameBase + ".webp"
+		if w > 0 {
+			variantName = fmt.Sprintf("%s-%dw.webp", nameBase, w)
+		}
+		vd, err := getImageVariant(b, variantName, func(path string) error {
+			return cwebp(path, cachedPath, w)
+		})
+		if err != nil {
+			return err
+		}
+		uri := img.addFile(b, variantName, vd)
+		vw := w
+		if w == 0 {
+			vw = img.Width
+		}
+		img.WebP = append(img.WebP, imageVariant{URL: uri, Width: vw})
+	}
+	return nil
+}
+
+// getImage returns processed image or nil if it's not in the cache
+func (b *Book) getImage(key string) (*bookImage, error) {
+	cachedPath := findCachedImage(b, key)
+	if cachedPath == "" {
+		return nil, nil
+	}
+	b.mu.Lock()
+	if b.images == nil {
+		b.images = map[string]*bookImage{}
+	}
+	img := b.images[key]
+	if img == nil {
+		img = &bookImage{}
+		b.images[key] = img
+	}
+	b.mu.Unlock()
+
+	img.once.Do(func() {
+		img.err = img.process(b, key, cachedPath)
+	})
+	return img, img.err
+}
+
+func srcsetAttr(variants []imageVariant) string {
+	var a []string
+	for _, v := range variants {
+		a = append(a, fmt.Sprintf("%s %dw", v.URL, v.Width))
+	}
+	return strings.Join(a, ", ")
+}
+
+// returns text of image caption, used as alt text
+func getImageCaption(block *notionapi.Block) string {
+	items, _ := block.Properties["caption"].([]interface{})
+	var a []string
+	for _, item := range items {
+		if v, ok := item.([]interface{}); ok && len(v) > 0 {
+			if s, ok := v[0].(string); ok {
+				a = append(a, s)
+			}
+		}
+	}
+	return strings.TrimSpace(strings.Join(a, ""))
+}
+
+func (g *HTMLGenerator) genImage(block *notionapi.Block, levelCls string) {
+	alt := template.HTMLEscapeString(getImageCaption(block))
+	key, _ := getImageURLs(block)
+	img, err := g.book.getImage(key)
+	if err != nil {
+		g.report(SeverityWarning, block, "processing image '%s' failed with '%s'", key, err)
+	}
+	if img == nil || img.URL == "" {
+		if key != "" {
+			g.report(SeverityInfo, block, "image '%s' is not in the cache, using notion's url. Use -download-images to download it", key)
+		}
+		fmt.Fprintf(g.f, `<img class="img%s" src="%s" alt="%s" />`+"\n", levelCls, block.ImageURL, alt)
+		return
+	}
+	g.page.images = append(g.page.images, img.files...)
+
+	// width of image in the page, as set in notion
+	w, h := img.Width, img.Height
+	if f := block.FormatImage; f != nil && f.BlockWidth > 0 && int(f.BlockWidth) < w {
+		h = h * int(f.BlockWidth) / w
+		w = int(f.BlockWidth)
+	}
+	sizeAttrs := ""
+	sizes := ""
+	if w > 0 && h > 0 {
+		sizeAttrs = fmt.Sprintf(` width="%d" height="%d"`, w, h)
+		if w > maxArticleImageWidth {
+			w = maxArticleImageWidth
+		}
+		sizes = fmt.Sprintf(`(max-width: %dpx) 100vw, %dpx`, w, w)
+	}
+	imgHTML := fmt.Sprintf(`<img class="img%s" src="%s"%s alt="%s" loading="lazy"`, levelCls, img.URL, sizeAttrs, alt)
+	if len(img.Srcset) > 0 {
+		imgHTML += fmt.Sprintf(` srcset="%s" sizes="%s"`, srcsetAttr(img.Srcset), sizes)
+	}
+	imgHTML += " />"
+	if len(img.WebP) == 0 {
+		g.writeString(imgHTML + "\n")
+		return
+	}
+	fmt.Fprintf(g.f, `<picture><source type="image/webp" srcset="%s" sizes="%s" />%s</picture>`+"\n", srcsetAttr(img.WebP), sizes, imgHTML)
+}
@@ -86,14 +86,16 @@ func loadPageFromCache(b *Book, pageID string) *notionapi.Page {
 	return &page
 }
 
-// I got "connection reset by peer" error once so retry download 3 times, with a short sleep in-between
+// I got "connection reset by peer" error once so retry download, with
+// exponentially increasing sleep in-between
 func downloadPageRetry(c *notionapi.Client, pageID string) (*notionapi.Page, error) {
 	var res *notionapi.Page
 	var err error
-	for i := 0; i < 3; i++ {
+	for i := 0; i < notionDownloader.MaxTries; i++ {
 		if i > 0 {
-			fmt.Printf("Download %s failed with '%s'\n", pageID, err)
-			time.Sleep(3 * time.Second) // not sure if it matters
+			delay := notionDownloader.retryDelay(i)
+			fmt.Printf("Download %s failed with '%s', retrying in %s\n", pageID, err, delay)
+			time.Sleep(delay)
 		}
 		res, err = c.DownloadPage(pageID)
 		if err == nil {
@@ -106,6 +108,9 @@ func downloadPageRetry(c *notionapi.Client, pageID string) (*notionapi.Page, err
 func downloadAndCachePage(b *Book, c *notionapi.Client, pageID string) (*notionapi.Page, error) {
 	//fmt.Printf("downloading page with id %s\n", pageID)
 	pageID = normalizeID(pageID)
+	// pages are downloaded in parallel so each needs its own logger
+	client := *c
+	c = &client
 	c.Logger, _ = openLogFileForPageID(pageID)
 	if c.Logger != nil {
 		defer func() {
@@ -113,11 +118,15 @@ func downloadAndCachePage(b *Book, c *notionapi.Client, pageID string) (*notiona
 			lf.Close()
 		}()
 	}
+	// notionapi drops sort and filter of collection views so we save raw records
+	recordsIntercept := &rawRecordsInterceptor{records: newNotionRawRecords()}
+	c.HTTPIntercept = recordsIntercept
 	cachedPath := filepath.Join(b.NotionCacheDir(), pageID+".json")
 	page, err := downloadPageRetry(c, pageID)
 	if err != nil {
 		return nil, err
 	}
+	saveNotionRawRecords(b, pageID, recordsIntercept.records)
 	d, err := json.MarshalIndent(page, "", "  ")
 	if err == nil {
 		err = ioutil.WriteFile(cachedPath, d, 0644)
@@ -126,6 +135,8 @@ func downloadAndCachePage(b *Book, c *notionapi.Client, pageID string) (*notiona
 		// not a fatal error, just a warning
 		fmt.Printf("json.Marshal() on pageID '%s' failed with %s\n", pageID, err)
 	}
+	// urls of images in notion expire so we download them with the page
+	downloadPageImages(b, page)
 	return page, nil
 }
 
@@ -133,43 +144,8 @@ var (
 	nNotionPagesFromCache int
 )
 
-func loadNotionPage(b *Book, c *notionapi.Client, pageID string, getFromCache bool, n int) (*notionapi.Page, error) {
-	if getFromCache {
-		page := loadPageFromCache(b, pageID)
-		if page != nil {
-			nNotionPagesFromCache++
-			//fmt.Printf("Got %d from cache %s %s\n", n, pageID, page.Root.Title)
-			return page, nil
-		}
-	}
-	page, err := downloadAndCachePage(b, c, pageID)
-	if err == nil {
-		fmt.Printf("Downloaded %d %s %s\n", n, page.ID, page.Root.Title)
-	}
-	return page, err
-}
-
 func loadNotionPages(b *Book, c *notionapi.Client, indexPageID string, idToPage map[string]*notionapi.Page, useCache bool) {
-	toVisit := []string{indexPageID}
-
-	n := 1
-	for len(toVisit) > 0 {
-		pageID := normalizeID(toVisit[0])
-		toVisit = toVisit[1:]
-
-		if _, ok := idToPage[pageID]; ok {
-			continue
-		}
-
-		page, err := loadNotionPage(b, c, pageID, useCache, n)
-		panicIfErr(err)
-		n++
-
-		idToPage[pageID] = page
-
-		subPages := findSubPageIDs(page.Root.Content)
-		toVisit = append(toVisit, subPages...)
-	}
+	crawlNotionPages(b, c, indexPageID, idToPage, useCache)
 }
 
 func loadAllPages(b *Book, c *notionapi.Client, startIDs []string, useCache bool) map[string]*notionapi.Page {
@@ -195,6 +171,10 @@ func rmCached(b *Book, pageID string) {
 	id := normalizeID(pageID)
 	rmFile(filepath.Join(notionLogDir, id+".go.log.txt"))
 	rmFile(filepath.Join(b.NotionCacheDir(), id+".json"))
+	// only pages with tables have records
+	if path := notionRecordsPath(b, id); pathExists(path) {
+		rmFile(path)
+	}
 }
 
 func createNotionLogDir() {
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/kjk/notionapi"
+)
+
+/*
+Date and user mentions in inline content ("@Jul 12, 2018", "@Krzysztof").
+
+notionapi.Date doesn't have the end of a date range, so we also read date
+attributes from raw "title" property of the block. They're in the same
+order as dates in block's InlineContent:
+[
+	["text"],
+	["‣", [["d", { "type": "daterange", "start_date": "2018-07-12", ... }]]]
+]
+
+Users are resolved to names via user records that notionapi saves with the
+page (and therefore in cached page json).
+*/
+
+// notionDate is like notionapi.Date but also has the end of a date range
+type notionDate struct {
+	// "date", "datetime", "daterange", "datetimerange"
+	Type string `json:"type"`
+	// "MMM DD, YYYY", "MM/DD/YYYY", "DD/MM/YYYY", "YYYY/MM/DD", "relative"
+	DateFormat string `json:"date_format"`
+	// "2018-07-12"
+	StartDate string `json:"start_date"`
+	// "09:00"
+	StartTime string `json:"start_time"`
+	EndDate   string `json:"end_date"`
+	EndTime   string `json:"end_time"`
+	// "America/Los_Angeles"
+	TimeZone string `json:"time_zone"`
+	// "H:mm" for 24hr, not given for 12hr
+	TimeFormat string `json:"time_format"`
+}
+
+func strPtrToStr(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func notionDateFromAPI(d *notionapi.Date) *notionDate {
+	return &notionDate{
+		Type:       d.Type,
+		DateFormat: d.DateFormat,
+		StartDate:  d.StartDate,
+		StartTime:  strPtrToStr(d.StartTime),
+		TimeZone:   strPtrToStr(d.TimeZone),
+		TimeFormat: strPtrToStr(d.TimeFormat),
+	}
+}
+
+// returns date attributes from raw "title" property, in order
+func getRawDates(block *notionapi.Block) []*notionDate {
+	items, _ := block.Properties["title"].([]interface{})
+	var res []*notionDate
+	for _, item := range items {
+		a, _ := item.([]interface{})
+		if len(a) < 2 {
+			continue
+		}
+		attrs, _ := a[1].([]interface{})
+		for _, attr := range attrs {
+			av, _ := attr.([]interface{})
+			if len(av) != 2 || av[0] != "d" {
+				continue
+			}
+			d, err := json.Marshal(av[1])
+			if err != nil {
+				continue
+			}
+			var date notionDate
+			if json.Unmarshal(d, &date) == nil {
+				res = append(res, &date)
+			}
+		}
+	}
+	return res
+}
+
+// collectDates remembers full dates (including end of range) for dates in
+// inline content of block and its children
+func (g *HTMLGenerator) collectDates(block *notionapi.Block) {
+	var dates []*notionapi.Date
+	for _, b := range block.InlineContent {
+		if b.Date != nil {
+			dates = append(dates, b.Date)
+		}
+	}
+	if len(dates) > 0 {
+		rawDates := getRawDates(block)
+		if len(rawDates) == len(dates) {
+			if g.dates == nil {
+				g.dates = map[*notionapi.Date]*notionDate{}
+			}
+			for i, d := range dates {
+				g.dates[d] = rawDates[i]
+			}
+		}
+	}
+	for _, child := range block.Content {
+		g.collectDates(child)
+	}
+}
+
+// converts Notion's date format to Go's time format. "relative" ("Today",
+// "Yesterday") doesn't make sense in a static page so we use the default
+func dateLayout(dateFormat string) string {
+	switch dateFormat {
+	case "MM/DD/YYYY":
+		return "01/02/2006"
+	case "DD/MM/YYYY":
+		return "02/01/2006"
+	case "YYYY/MM/DD":
+		return "2006/01/02"
+	}
+	return "Jan 2, 2006"
+}
+
+func timeLayout(timeFormat string) string {
+	if timeFormat == "H:mm" {
+		return "15:04"
+	}
+	return "3:04 PM"
+}
+
+// returns abbreviation of time zone e.g. "PDT" or name of the zone if
+// it's not known
+func timeZoneName(zone string, t time.Time) string {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return zone
+	}
+	return t.In(loc).Format("MST")
+}
+
+func formatDatePart(d *notionDate, day, tm string) (string, error) {
+	withTime := strings.Contains(d.Type, "time") && tm != ""
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return "", err
+	}
+	s := t.Format(dateLayout(d.DateFormat))
+	if !withTime {
+		return s, nil
+	}
+	t, err = time.Parse("2006-01-02 15:04", day+" "+tm)
+	if err != nil {
+		return "", err
+	}
+	return s + " " + t.Format(timeLayout(d.TimeFormat)), nil
+}
+
+// formatNotionDate formats a date the way Notion shows it e.g.
+// "Jul 12, 2018 9:00 AM → Jul 14, 2018 5:00 PM PDT"
+func formatNotionDate(d *notionDate) (string, error) {
+	s, err := formatDatePart(d, d.StartDate, d.StartTime)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(d.Type, "range") && d.EndDate != "" {
+		end, err := formatDatePart(d, d.EndDate, d.EndTime)
+		if err != nil {
+			return "", err
+		}
+		s += " → " + end
+	}
+	if strings.Contains(d.Type, "time") && d.StartTime != "" && d.TimeZone != "" {
+		// abbreviation depends on daylight saving time so it's for the start
+		t, _ := time.Parse("2006-01-02 15:04", d.StartDate+" "+d.StartTime)
+		s += " " + timeZoneName(d.TimeZone, t)
+	}
+	return s, nil
+}
+
+// returns date in machine-readable format for datetime attribute of <time>
+func dateTimeAttr(d *notionDate) string {
+	if strings.Contains(d.Type, "time") && d.StartTime != "" {
+		return d.StartDate + "T" + d.StartTime
+	}
+	return d.StartDate
+}
+
+func (g *HTMLGenerator) dateMentionHTML(apiDate *notionapi.Date) string {
+	d := g.dates[apiDate]
+	if d == nil {
+		d = notionDateFromAPI(apiDate)
+	}
+	s, err := formatNotionDate(d)
+	if err != nil {
+		g.report(SeverityWarning, nil, "invalid date '%s': %s", d.StartDate, err)
+		return fmt.Sprintf(`<span class="date">@%s</span>`, html.EscapeString(d.StartDate))
+	}
+	return fmt.Sprintf(`<time class="date" datetime="%s">@%s</time>`, dateTimeAttr(d), html.EscapeString(s))
+}
+
+func findNotionUser(users []*notionapi.User, id string) *notionapi.User {
+	for _, u := range users {
+		if u != nil && strings.EqualFold(u.ID, id) {
+			return u
+		}
+	}
+	return nil
+}
+
+// a user is usually in the page that mentions them but could have been
+// loaded with a different page of the book
+func (g *HTMLGenerator) findUser(id string) *notionapi.User {
+	if u := findNotionUser(g.page.NotionPage.Users, id); u != nil {
+		return u
+	}
+	for _, page := range g.book.pageIDToPage {
+		if u := findNotionUser(page.Users, id); u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+func userDisplayName(u *notionapi.User) string {
+	return strings.TrimSpace(u.GivenName + " " + u.FamilyName)
+}
+
+func (g *HTMLGenerator) userMentionHTML(userID string) string {
+	name := ""
+	if u := g.findUser(userID); u != nil {
+		name = userDisplayName(u)
+	}
+	if name == "" {
+		g.report(SeverityWarning, nil, "unknown user '%s'", userID)
+		name = "Unknown user"
+	}
+	return fmt.Sprintf(`<span class="user">@%s</span>`, html.EscapeString(name))
+}
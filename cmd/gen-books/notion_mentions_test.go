@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kjk/notionapi"
+)
+
+func loadFixturePage(t *testing.T, name string) *Page {
+	d, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notionPage notionapi.Page
+	if err = json.Unmarshal(d, &notionPage); err != nil {
+		t.Fatal(err)
+	}
+	return &Page{
+		NotionPage: &notionPage,
+		NotionID:   normalizeID(notionPage.ID),
+		Title:      notionPage.Root.Title,
+	}
+}
+
+func TestFormatNotionDate(t *testing.T) {
+	tests := []struct {
+		d   notionDate
+		exp string
+	}{
+		{notionDate{Type: "date", StartDate: "2018-07-12"}, "Jul 12, 2018"},
+		{notionDate{Type: "date", DateFormat: "relative", StartDate: "2018-07-12"}, "Jul 12, 2018"},
+		{notionDate{Type: "date", DateFormat: "DD/MM/YYYY", StartDate: "2018-07-02"}, "02/07/2018"},
+		// time is ignored for dates without time
+		{notionDate{Type: "date", StartDate: "2018-07-12", StartTime: "09:00"}, "Jul 12, 2018"},
+		{notionDate{Type: "datetime", StartDate: "2018-07-12", StartTime: "13:05"}, "Jul 12, 2018 1:05 PM"},
+		{notionDate{Type: "datetime", StartDate: "2018-07-12", StartTime: "13:05", TimeFormat: "H:mm"}, "Jul 12, 2018 13:05"},
+		{notionDate{Type: "datetime", StartDate: "2018-07-12", StartTime: "13:05", TimeZone: "UTC"}, "Jul 12, 2018 1:05 PM UTC"},
+		// unknown time zone is shown as is
+		{notionDate{Type: "datetime", StartDate: "2018-07-12", StartTime: "13:05", TimeZone: "Nowhere/Town"}, "Jul 12, 2018 1:05 PM Nowhere/Town"},
+		{notionDate{Type: "daterange", StartDate: "2018-07-12", EndDate: "2018-07-14"}, "Jul 12, 2018 → Jul 14, 2018"},
+		// range without end is a single date
+		{notionDate{Type: "daterange", StartDate: "2018-07-12"}, "Jul 12, 2018"},
+		{notionDate{Type: "datetimerange", StartDate: "2018-07-12", StartTime: "09:00", EndDate: "2018-07-12", EndTime: "17:00", TimeFormat: "H:mm", TimeZone: "UTC"}, "Jul 12, 2018 09:00 → Jul 12, 2018 17:00 UTC"},
+	}
+	for _, test := range tests {
+		got, err := formatNotionDate(&test.d)
+		if err != nil {
+			t.Errorf("formatNotionDate(%#v) failed with %s", test.d, err)
+			continue
+		}
+		if got != test.exp {
+			t.Errorf("formatNotionDate(%#v) = %q, expected %q", test.d, got, test.exp)
+		}
+	}
+
+	_, err := formatNotionDate(&notionDate{Type: "date", StartDate: "2018-13-45"})
+	if err == nil {
+		t.Errorf("expected error for invalid date")
+	}
+}
+
+func TestMentionsToHTML(t *testing.T) {
+	page := loadFixturePage(t, "mentions.json")
+	book := &Book{Dir: "test"}
+	s := string(notionToHTML(page, book))
+	exp := []string{
+		`Released on <time class="date" datetime="2018-07-12">@Jul 12, 2018</time>`,
+		`<time class="date" datetime="2018-07-12T09:00">@12/07/2018 09:00 UTC</time>`,
+		// end of range is only in raw properties
+		`<time class="date" datetime="2018-07-12">@2018/07/12 → 2018/07/14</time>`,
+		`<time class="date" datetime="2018-07-12T09:00">@07/12/2018 9:00 AM → 07/14/2018 5:30 PM</time>`,
+		`Written by <span class="user">@Krzysztof Kowalczyk</span>`,
+		`<span class="user">@Unknown user</span>`,
+		`<span class="date">@2018-13-45</span>`,
+	}
+	for _, e := range exp {
+		if !strings.Contains(s, e) {
+			t.Errorf("expected %q in:\n%s", e, s)
+		}
+	}
+	if strings.Contains(s, "TODO") || strings.Contains(s, "‣") {
+		t.Errorf("unexpected placeholder in:\n%s", s)
+	}
+}
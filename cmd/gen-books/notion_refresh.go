@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kjk/notionapi"
+)
+
+/*
+-refresh-changed re-downloads only pages that changed in notion since they
+were cached.
+
+We walk the book starting from the start page, one level of sub-pages at
+a time. For each level we get current metadata of the pages in a single
+getRecordValues request and compare last edited time and version with the
+cached page. Pages that changed or are not in the cache are downloaded.
+Cached pages that are no longer part of the book are removed.
+*/
+
+// max number of ids in a single getRecordValues request
+const maxRecordValuesBatch = 100
+
+// notionChange describes a page changed by -refresh-changed
+type notionChange struct {
+	// "changed", "added" or "removed"
+	Kind   string
+	ID     string
+	Title  string
+	Reason string
+}
+
+// returns current metadata of pages with given ids. Pages that no longer
+// exist or are not accessible are not in the result
+func getPagesMetadata(c *notionapi.Client, ids []string) (map[string]*notionapi.Block, error) {
+	res := map[string]*notionapi.Block{}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxRecordValuesBatch {
+			n = maxRecordValuesBatch
+		}
+		var dashIDs []string
+		for _, id := range ids[:n] {
+			dashID, _ := notionapi.NormalizeID(id)
+			dashIDs = append(dashIDs, dashID)
+		}
+		ids = ids[n:]
+
+		rsp, err := c.GetRecordValues(dashIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rsp.Results {
+			if r == nil || r.Value == nil {
+				continue
+			}
+			res[normalizeID(r.Value.ID)] = r.Value
+		}
+	}
+	return res, nil
+}
+
+// returns why cached page is different than current metadata or empty
+// string if it didn't change
+func pageChangeReason(cached *notionapi.Page, current *notionapi.Block) string {
+	root := cached.Root
+	if root.LastEditedTime != current.LastEditedTime {
+		return fmt.Sprintf("edited %s, cached %s", current.UpdatedOn().Format("2006-01-02 15:04"), root.UpdatedOn().Format("2006-01-02 15:04"))
+	}
+	if root.Version != current.Version {
+		return fmt.Sprintf("version %d, cached %d", current.Version, root.Version)
+	}
+	return ""
+}
+
+// downloads pages in parallel, using notionDownloader.Workers workers
+func downloadPages(b *Book, c *notionapi.Client, ids []string) (map[string]*notionapi.Page, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	res := map[string]*notionapi.Page{}
+	nWorkers := notionDownloader.Workers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	sem := make(chan bool, nWorkers)
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- true
+		go func(id string) {
+			page, err := downloadAndCachePage(b, c, id)
+			mu.Lock()
+			if err != nil {
+				fmt.Printf("Downloading page %s failed with '%s'\n", id, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				res[id] = page
+			}
+			mu.Unlock()
+			<-sem
+			wg.Done()
+		}(id)
+	}
+	wg.Wait()
+	return res, firstErr
+}
+
+// returns ids of pages in notion cache of the book
+func getCachedPageIDs(b *Book) []string {
+	var res []string
+	fileInfos, err := ioutil.ReadDir(b.NotionCacheDir())
+	if err != nil {
+		return nil
+	}
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if fi.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		res = append(res, strings.TrimSuffix(name, ".json"))
+	}
+	return res
+}
+
+// refreshChangedPages loads pages of the book, re-downloading those that
+// changed in notion since they were cached
+func refreshChangedPages(b *Book, c *notionapi.Client, idToPage map[string]*notionapi.Page) {
+	var changes []*notionChange
+	seen := map[string]bool{}
+	startID := normalizeID(b.NotionStartPageID)
+	toVisit := []string{startID}
+	seen[startID] = true
+
+	for len(toVisit) > 0 {
+		meta, err := getPagesMetadata(c, toVisit)
+		panicIfErr(err)
+
+		var toDownload []string
+		for _, id := range toVisit {
+			cached := loadPageFromCache(b, id)
+			if cached == nil {
+				changes = append(changes, &notionChange{Kind: "added", ID: id})
+				toDownload = append(toDownload, id)
+				continue
+			}
+			current := meta[id]
+			if current == nil {
+				// can't tell if it changed so we keep the cached version
+				fmt.Printf("Didn't get metadata for page %s '%s', using cached version\n", id, cached.Root.Title)
+				idToPage[id] = cached
+				continue
+			}
+			reason := pageChangeReason(cached, current)
+			if reason == "" {
+				idToPage[id] = cached
+				continue
+			}
+			changes = append(changes, &notionChange{Kind: "changed", ID: id, Title: cached.Root.Title, Reason: reason})
+			toDownload = append(toDownload, id)
+		}
+
+		downloaded, err := downloadPages(b, c, toDownload)
+		panicIfErr(err)
+		for id, page := range downloaded {
+			idToPage[id] = page
+		}
+		for _, ch := range changes {
+			if page := downloaded[ch.ID]; page != nil {
+				ch.Title = page.Root.Title
+			}
+		}
+
+		var next []string
+		for _, id := range toVisit {
+			for _, subID := range findSubPageIDs(idToPage[id].Root.Content) {
+				if !seen[subID] {
+					seen[subID] = true
+					next = append(next, subID)
+				}
+			}
+		}
+		toVisit = next
+	}
+
+	for _, id := range getCachedPageIDs(b) {
+		if seen[id] {
+			continue
+		}
+		ch := &notionChange{Kind: "removed", ID: id}
+		if page := loadPageFromCache(b, id); page != nil {
+			ch.Title = page.Root.Title
+		}
+		changes = append(changes, ch)
+		rmCached(b, id)
+	}
+
+	printNotionChanges(b, changes)
+}
+
+func printNotionChanges(b *Book, changes []*notionChange) {
+	fmt.Printf("Book %s: %d pages changed in notion\n", b.Title, len(changes))
+	sort.Slice(changes, func(i, j int) bool {
+		c1 := changes[i]
+		c2 := changes[j]
+		if c1.Kind != c2.Kind {
+			return c1.Kind < c2.Kind
+		}
+		return c1.Title < c2.Title
+	})
+	for _, ch := range changes {
+		fmt.Printf("  %-8s %s '%s'", ch.Kind, ch.ID, ch.Title)
+		if ch.Reason != "" {
+			fmt.Printf(" (%s)", ch.Reason)
+		}
+		fmt.Printf("\n")
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"html"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 
@@ -17,10 +17,80 @@ type HTMLGenerator struct {
 	f            *bytes.Buffer
 	page         *Page
 	level        int
-	nToggle      int
 	err          error
 	book         *Book
 	currHeaderID int
+	// ids of headings already in the page
+	headingIDs map[string]bool
+	// full dates of date mentions, see collectDates
+	dates map[*notionapi.Date]*notionDate
+	// raw collection records of the page, see genCollectionView
+	rawRecords       *notionRawRecords
+	rawRecordsLoaded bool
+}
+
+var (
+	// ids of elements in page templates
+	reservedHeadingIDs = map[string]bool{
+		"toc": true, "link-home": true, "search-input": true, "search-results": true,
+		"search-results-window": true, "search-results-help": true, "blur-overlay": true,
+		"msg-area": true, "arrow-expanded": true, "arrow-not-expanded": true,
+	}
+)
+
+func isAllDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isReservedHeadingID(id string) bool {
+	return reservedHeadingIDs[id] || strings.HasPrefix(id, "toggle-") || strings.HasPrefix(id, "icon-")
+}
+
+// returns id of a heading, derived from its text so that it doesn't
+// change when other headings are added. If two headings have the same
+// text, the second gets "-2" suffix etc.
+func (g *HTMLGenerator) headingID(text string) string {
+	id := urlify(text)
+	// numeric ids are old-style heading ids we keep as aliases
+	if id == "" || isAllDigits(id) {
+		id = "h" + id
+	}
+	if isReservedHeadingID(id) {
+		id = "h-" + id
+	}
+	base := id
+	for n := 2; g.headingIDs[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	if g.headingIDs == nil {
+		g.headingIDs = map[string]bool{}
+	}
+	g.headingIDs[id] = true
+	return id
+}
+
+// tag is "h1" or "h2"
+func (g *HTMLGenerator) genHeading(block *notionapi.Block, tag string, levelCls string) {
+	g.currHeaderID++
+	text := genInlineBlocksText(block.InlineContent)
+	h := HeadingInfo{
+		Text: text,
+		ID:   g.headingID(text),
+	}
+	g.page.Headings = append(g.page.Headings, h)
+	start := fmt.Sprintf(`<%s class="hdr%s" id="%s">`, tag, levelCls, h.ID)
+	// headings used to have ids 1, 2, 3 etc. We keep them as aliases
+	// so that existing links to headings still work
+	if n := g.book.headingAliases.numericID(g.page, h.ID, g.currHeaderID); n > 0 {
+		start += fmt.Sprintf(`<span id="%d" class="hdr-alias"></span>`, n)
+	}
+	close := fmt.Sprintf(`<a class="hdr-link" href="#%s">#</a></%s>`, h.ID, tag)
+	g.genBlockSurrouded(block, start, close)
 }
 
 // only hex chars seem to be valid
@@ -82,15 +152,41 @@ func (g *HTMLGenerator) maybeReplaceNotionLink(uri string) string {
 		return uri
 	}
 	page := g.book.idToPage[id]
+	if page == nil {
+		return uri
+	}
 	return page.URL()
 }
 
+// remembers that the page links to a page in the book
+func (g *HTMLGenerator) addLinkedPage(uri string) {
+	page := g.book.idToPage[extractNotionIDFromURL(uri)]
+	if page == nil {
+		return
+	}
+	for _, p := range g.page.linkedPages {
+		if p == page {
+			return
+		}
+	}
+	g.page.linkedPages = append(g.page.linkedPages, page)
+}
+
+// report records a problem in the page we're generating. block can be nil
+func (g *HTMLGenerator) report(sev Severity, block *notionapi.Block, format string, args ...interface{}) {
+	blockID := ""
+	if block != nil {
+		blockID = block.ID
+	}
+	reportPage(sev, g.book, g.page, blockID, format, args...)
+}
+
 func (g *HTMLGenerator) getURLAndTitleForBlock(block *notionapi.Block) (string, string) {
 	id := normalizeID(block.ID)
 	page := g.book.idToPage[id]
 	if page == nil {
 		title := block.Title
-		fmt.Printf("No article for id %s %s\n", id, title)
+		g.report(SeverityWarning, block, "no article for page '%s'", title)
 		url := "/article/" + id + "/" + urlify(title)
 		return url, title
 	}
@@ -116,14 +212,12 @@ func (g *HTMLGenerator) reportIfInvalidLink(uri string) {
 	if strings.HasPrefix(uri, "http") {
 		return
 	}
-	pageID := normalizeID(g.page.ID)
-	fmt.Printf("Found invalid link '%s' in page https://notion.so/%s", uri, pageID)
+	msg := fmt.Sprintf("invalid link '%s'", uri)
 	destPage := findPageByID(g.book, uri)
 	if destPage != nil {
-		fmt.Printf(" most likely pointing to https://notion.so/%s\n", normalizeID(destPage.NotionPage.ID))
-	} else {
-		fmt.Printf("\n")
+		msg += fmt.Sprintf(", most likely pointing to %s%s", notionBaseURL, normalizeID(destPage.NotionPage.ID))
 	}
+	g.report(SeverityWarning, nil, "%s", msg)
 }
 
 func (g *HTMLGenerator) genInlineBlock(b *notionapi.InlineBlock) {
@@ -147,17 +241,17 @@ func (g *HTMLGenerator) genInlineBlock(b *notionapi.InlineBlock) {
 	skipText := false
 	if b.Link != "" {
 		g.reportIfInvalidLink(b.Link)
+		g.addLinkedPage(b.Link)
 		link := g.maybeReplaceNotionLink(b.Link)
 		start += fmt.Sprintf(`<a href="%s">%s</a>`, link, b.Text)
 		skipText = true
 	}
 	if b.UserID != "" {
-		start += fmt.Sprintf(`<span class="user">@%s</span>`, b.UserID)
+		start += g.userMentionHTML(b.UserID)
 		skipText = true
 	}
 	if b.Date != nil {
-		// TODO: serialize date properly
-		start += fmt.Sprintf(`<span class="date">@TODO: date</span>`)
+		start += g.dateMentionHTML(b.Date)
 		skipText = true
 	}
 	if !skipText {
@@ -247,30 +341,44 @@ func (g *HTMLGenerator) genEmbed(block *notionapi.Block) {
 		g.genReplitEmbed(block)
 		return
 	}
-	panicIf(true, "unsupported embed %s", uri)
+	g.report(SeverityError, block, "unsupported embed '%s'", uri)
 }
 
 func (g *HTMLGenerator) genReplitEmbed(block *notionapi.Block) {
 	uri := block.FormatEmbed.DisplaySource
 	uri = strings.Replace(uri, "?lite=true", "", -1)
 
+	g.book.mu.Lock()
+	g.book.cacheUsage.replitURLs[uri] = true
 	replit := g.book.replitCache.replits[uri]
 	if replit == nil || flgRedownloadReplit {
 		var isNew bool
 		var err error
 		replit, isNew, err = downloadAndCacheReplit(g.book.replitCache, uri)
-		panicIfErr(err)
+		if err != nil {
+			g.book.mu.Unlock()
+			g.report(SeverityError, block, "downloading replit '%s' failed with '%s'", uri, err)
+			return
+		}
 		fmt.Printf("genReplitEmbed: downloaded %s,  isNew: %v\n", uri+".zip", isNew)
 	}
-	f, err := getSourceFileFromReplit(g.book, replit)
+	g.book.mu.Unlock()
+	f, err := getSourceFileFromReplit(g.book, g.page, replit)
+	if _, ok := err.(*RunError); ok {
+		// show the code even if we failed to get its output. Path is
+		// a temporary file so we also show the replit url
+		g.report(SeverityError, block, "replit '%s': %s", uri, err)
+		err = nil
+	}
 	if err != nil {
 		file := replit.files[0]
-		fmt.Printf("genReplitEmbed: getSourceFileFromReplit (name: '%s', uri: '%s') failed with '%s'\n", file.name, uri, err)
-		fmt.Printf("file '%s':\n%s\n", file.name, file.data)
-		panicIfErr(err)
+		g.report(SeverityError, block, "getting source file '%s' from replit '%s' failed with '%s'", file.name, uri, err)
+		return
 	}
 	f.EmbedURL = uri
 	f.PlaygroundURI = uri
+	// remember so that changes to replit are detected in build manifest
+	g.page.SourceFiles = append(g.page.SourceFiles, f)
 	g.genSourceFile(f)
 }
 
@@ -284,13 +392,22 @@ func pickReplitFile(files []*ReplitFile) *ReplitFile {
 			return rf
 		}
 	}
+	for _, rf := range files {
+		if strings.HasPrefix(rf.name, "main.") && findLangRunnerForFile(rf.name) != nil {
+			return rf
+		}
+	}
 	return files[0]
 }
 
-func getSourceFileFromReplit(b *Book, replit *Replit) (*SourceFile, error) {
+func getSourceFileFromReplit(b *Book, page *Page, replit *Replit) (*SourceFile, error) {
 	f := &SourceFile{}
 	rf := pickReplitFile(replit.files)
 	f.Lang = getLangFromFileExt(rf.name)
+	f.FileName = rf.name
+	f.EmbedURL = replit.url
+	f.page = page
+	f.recreateOutput = shouldRecreateOutput(page, replit.url)
 	err := setSourceFileData(f, []byte(rf.data))
 	err = getOutputCachedForReplit(b, replit, f)
 	return f, err
@@ -331,74 +448,75 @@ func (g *HTMLGenerator) genGitEmbed(block *notionapi.Block) {
 	// currently we only handle source code file embeds but might handle
 	// others (graphs etc.)
 	if f == nil {
-		fmt.Printf("genEmbed: didn't find source file for url %s\n", uri)
+		g.report(SeverityWarning, block, "didn't find source file for embed '%s'", uri)
 		return
 	}
 
 	g.genSourceFile(f)
 }
 
-func (g *HTMLGenerator) genCollectionView(block *notionapi.Block) {
-	viewInfo := block.CollectionViews[0]
-	view := viewInfo.CollectionView
-	columns := view.Format.TableProperties
-	s := `<table class="notion-table"><thead><tr>`
-	for _, col := range columns {
-		colName := col.Property
-		colInfo := viewInfo.Collection.CollectionSchema[colName]
-		name := ""
-		if colInfo != nil {
-			name = colInfo.Name
+// returns widths of columns as fractions that add up to 1. Columns without
+// a ratio share what's left after columns with a ratio
+func getColumnRatios(cols []*notionapi.Block) []float64 {
+	res := make([]float64, len(cols))
+	total := 0.0
+	nMissing := 0
+	for i, col := range cols {
+		if col.FormatColumn != nil && col.FormatColumn.ColumnRation > 0 {
+			res[i] = col.FormatColumn.ColumnRation
+			total += res[i]
 		} else {
-			fmt.Printf("Missing colInfo in block ID '%s'\n", block.ID)
+			nMissing++
 		}
-		s += `<th>` + html.EscapeString(name) + `</th>`
-	}
-	s += `</tr></thead>`
-	s += `<tbody>`
-	for _, row := range viewInfo.CollectionRows {
-		s += `<tr>`
-		props := row.Properties
-		for _, col := range columns {
-			colName := col.Property
-			v := props[colName]
-			colVal := propsValueToText(v)
-			if colVal == "" {
-				// use &nbsp; so that empty row still shows up
-				// could also set a min-height to 1em or sth. like that
-				s += `<td>&nbsp;</td>`
-			} else {
-				//colInfo := viewInfo.Collection.CollectionSchema[colName]
-				// TODO: format colVal according to colInfo
-				s += `<td>` + html.EscapeString(colVal) + `</td>`
+	}
+	if nMissing > 0 {
+		missing := (1 - total) / float64(nMissing)
+		if total == 0 || missing <= 0 {
+			// can't trust the ratios so use equal widths
+			for i := range res {
+				res[i] = 1
+			}
+		} else {
+			for i := range res {
+				if res[i] == 0 {
+					res[i] = missing
+				}
 			}
 		}
-		s += `</tr>`
 	}
-	s += `</tbody>`
-	s += `</table>`
-	g.writeString(s)
+	sum := 0.0
+	for _, r := range res {
+		sum += r
+	}
+	for i := range res {
+		res[i] /= sum
+	}
+	return res
 }
 
-// Children of BlockColumnList are BlockColumn blocks
+// Children of BlockColumnList are BlockColumn blocks. Width of a column is
+// its flex-grow so that columns shrink proportionally and the gap between
+// them is not part of the ratio. On narrow screens columns are stacked
 func (g *HTMLGenerator) genColumnList(block *notionapi.Block) {
-	panicIf(block.Type != notionapi.BlockColumnList, "unexpected block type '%s'", block.Type)
-	nColumns := len(block.Content)
-	panicIf(nColumns == 0, "has no columns")
-	// TODO: for now equal width columns
-	s := `<div class="column-list">`
-	g.writeString(s)
-
-	for _, col := range block.Content {
-		// TODO: get column ration from col.FormatColumn.ColumnRation, which is float 0...1
-		panicIf(col.Type != notionapi.BlockColumn, "unexpected block type '%s'", col.Type)
-		g.writeString(`<div>`)
-		g.genBlocks(col.Content)
+	if len(block.Content) == 0 {
+		g.report(SeverityWarning, block, "column list has no columns")
+		return
+	}
+	ratios := getColumnRatios(block.Content)
+	g.writeString(`<div class="column-list">`)
+	for i, col := range block.Content {
+		ratio := strconv.FormatFloat(math.Round(ratios[i]*10000)/10000, 'f', -1, 64)
+		fmt.Fprintf(g.f, `<div class="column" style="flex-grow: %s">`, ratio)
+		if col.Type == notionapi.BlockColumn {
+			g.genBlocks(col.Content)
+		} else {
+			// show the block as a column of its own
+			g.report(SeverityWarning, col, "unexpected block type '%s' in column list", col.Type)
+			g.genBlock(col)
+		}
 		g.writeString(`</div>`)
 	}
-
-	s = `</div>`
-	g.writeString(s)
+	g.writeString(`</div>`)
 }
 
 func (g *HTMLGenerator) newBuffer() *bytes.Buffer {
@@ -413,55 +531,16 @@ func (g *HTMLGenerator) restoreBuffer(b *bytes.Buffer) []byte {
 	return d
 }
 
-func (g *HTMLGenerator) genToggle(block *notionapi.Block) {
-	panicIf(block.Type != notionapi.BlockToggle, "unexpected block type '%s'", block.Type)
-	g.nToggle++
-	id := strconv.Itoa(g.nToggle)
-
+// toggles are <details> so that they work without JavaScript. app.js opens
+// them when url points to a heading inside
+func (g *HTMLGenerator) genToggle(block *notionapi.Block, levelCls string) {
 	inline := g.getInline(block.InlineContent)
 
 	b := g.newBuffer()
 	g.genBlocks(block.Content)
 	inner := g.restoreBuffer(b)
 
-	s := fmt.Sprintf(`<div style="width: 100%%; margin-top: 2px; margin-bottom: 1px;">
-    <div style="display: flex; align-items: flex-start; width: 100%%; padding-left: 2px; color: rgb(66, 66, 65);">
-
-        <div style="margin-right: 4px; width: 24px; flex-grow: 0; flex-shrink: 0; display: flex; align-items: center; justify-content: center; min-height: calc((1.5em + 3px) + 3px); padding-right: 2px;">
-            <div id="toggle-toggle-%s" onclick="javascript:onToggleClick(this)" class="toggler" style="align-items: center; user-select: none; display: flex; width: 1.25rem; height: 1.25rem; justify-content: center; flex-shrink: 0;">
-
-                <svg id="toggle-closer-%s" width="100%%" height="100%%" viewBox="0 0 100 100" style="fill: currentcolor; display: none; width: 0.6875em; height: 0.6875em; transition: transform 300ms ease-in-out; transform: rotateZ(180deg);">
-                    <polygon points="5.9,88.2 50,11.8 94.1,88.2 "></polygon>
-                </svg>
-
-                <svg id="toggle-opener-%s" width="100%%" height="100%%" viewBox="0 0 100 100" style="fill: currentcolor; display: block; width: 0.6875em; height: 0.6875em; transition: transform 300ms ease-in-out; transform: rotateZ(90deg);">
-                    <polygon points="5.9,88.2 50,11.8 94.1,88.2 "></polygon>
-                </svg>
-            </div>
-        </div>
-
-        <div style="flex: 1 1 0px; min-width: 1px;">
-            <div style="display: flex;">
-                <div style="padding-top: 3px; padding-bottom: 3px">%s</div>
-            </div>
-
-            <div style="margin-left: -2px; display: none" id="toggle-content-%s">
-                <div style="display: flex; flex-direction: column;">
-                    <div style="width: 100%%; margin-top: 2px; margin-bottom: 0px;">
-                        <div style="color: rgb(66, 66, 65);">
-							<div style="">
-								%s
-                                <!-- <div style="padding: 3px 2px;">text inside list</div> -->
-                            </div>
-                        </div>
-                    </div>
-                </div>
-            </div>
-        </div>
-    </div>
-</div>
-`, id, id, id, string(inline), id, string(inner))
-	g.writeString(s)
+	fmt.Fprintf(g.f, `<details class="toggle%s"><summary>%s</summary><div class="toggle-content">%s</div></details>`+"\n", levelCls, string(inline), string(inner))
 }
 
 func (g *HTMLGenerator) writeString(s string) {
@@ -480,27 +559,9 @@ func (g *HTMLGenerator) genBlock(block *notionapi.Block) {
 		close := `</p>`
 		g.genBlockSurrouded(block, start, close)
 	case notionapi.BlockHeader:
-		g.currHeaderID++
-		h := HeadingInfo{
-			Text: genInlineBlocksText(block.InlineContent),
-			// TODO: ID should be url-ified text
-			ID: strconv.Itoa(g.currHeaderID),
-		}
-		g.page.Headings = append(g.page.Headings, h)
-		start := fmt.Sprintf(`<h1 class="hdr%s" id="%s">`, levelCls, h.ID)
-		close := `</h1>`
-		g.genBlockSurrouded(block, start, close)
+		g.genHeading(block, "h1", levelCls)
 	case notionapi.BlockSubHeader:
-		g.currHeaderID++
-		h := HeadingInfo{
-			Text: genInlineBlocksText(block.InlineContent),
-			// TODO: ID should be url-ified text
-			ID: strconv.Itoa(g.currHeaderID),
-		}
-		g.page.Headings = append(g.page.Headings, h)
-		start := fmt.Sprintf(`<h2 class="hdr%s" id="%s">`, levelCls, h.ID)
-		close := `</h2>`
-		g.genBlockSurrouded(block, start, close)
+		g.genHeading(block, "h2", levelCls)
 	case notionapi.BlockTodo:
 		clsChecked := ""
 		if block.IsChecked {
@@ -510,7 +571,7 @@ func (g *HTMLGenerator) genBlock(block *notionapi.Block) {
 		close := `</div>`
 		g.genBlockSurrouded(block, start, close)
 	case notionapi.BlockToggle:
-		g.genToggle(block)
+		g.genToggle(block, levelCls)
 	case notionapi.BlockQuote:
 		start := fmt.Sprintf(`<blockquote class="%s">`, levelCls)
 		close := `</blockquote>`
@@ -535,7 +596,7 @@ func (g *HTMLGenerator) genBlock(block *notionapi.Block) {
 			</pre>`, levelCls, block.CodeLanguage, levelCls, code)
 		*/
 		var tmp bytes.Buffer
-		htmlHighlight(&tmp, string(block.Code), block.CodeLanguage, "")
+		htmlHighlight(&tmp, string(block.Code), block.CodeLanguage, g.book.defaultLang)
 		d := tmp.Bytes()
 		var info CodeBlockInfo
 		// TODO: set Lang, GitHubURI and PlaygroundURI
@@ -547,17 +608,41 @@ func (g *HTMLGenerator) genBlock(block *notionapi.Block) {
 		s := fmt.Sprintf(`<script src="%s.js"></script>`, block.Source)
 		g.writeString(s)
 	case notionapi.BlockImage:
-		link := block.ImageURL
-		fmt.Fprintf(g.f, `<img class="%s" style="width: 100%%" src="%s" />`+"\n", levelCls, link)
+		g.genImage(block, levelCls)
 	case notionapi.BlockColumnList:
 		g.genColumnList(block)
+	case notionapi.BlockColumn:
+		// columns are rendered by genColumnList
+		g.report(SeverityWarning, block, "column outside of column list")
+		g.genBlocks(block.Content)
 	case notionapi.BlockCollectionView:
 		g.genCollectionView(block)
 	case notionapi.BlockEmbed:
 		g.genEmbed(block)
+	case notionapi.BlockVideo:
+		g.genVideo(block, levelCls)
+	case notionapi.BlockFile:
+		g.genFile(block, levelCls)
+	case notionapi.BlockComment:
+		// comments are not part of the content
+	case blockCallout:
+		g.genCallout(block, levelCls)
+	case blockEquation:
+		g.genEquation(block, levelCls)
+	case blockPDF:
+		g.genPDF(block, levelCls)
+	case blockAudio:
+		g.genAudio(block, levelCls)
+	case blockTableOfContents:
+		g.genTableOfContents(levelCls)
+	case blockBreadcrumb:
+		g.genBreadcrumb(levelCls)
+	case blockSyncedBlock:
+		g.genContent(block)
+	case blockSyncedBlockRef:
+		g.genSyncedBlockRef(block)
 	default:
-		fmt.Printf("Unsupported block type '%s', id: %s\n", block.Type, block.ID)
-		panic(fmt.Sprintf("Unsupported block type '%s'", block.Type))
+		g.genUnsupportedBlock(block, levelCls)
 	}
 }
 
@@ -565,7 +650,7 @@ func (g *HTMLGenerator) genBlocks(blocks []*notionapi.Block) {
 	for len(blocks) > 0 {
 		block := blocks[0]
 		if block == nil {
-			fmt.Printf("Missing block\n")
+			g.report(SeverityWarning, nil, "missing block")
 			blocks = blocks[1:]
 			continue
 		}
@@ -611,6 +696,7 @@ func (g *HTMLGenerator) Gen() []byte {
 	}
 	rootPage := g.page.NotionPage.Root
 	f := rootPage.FormatPage
+	g.collectDates(rootPage)
 	g.writeString(`<p></p>`)
 	if f != nil && f.PageFont == "mono" {
 		g.writeString(`<div style="font-family: monospace">`)
@@ -619,7 +705,11 @@ func (g *HTMLGenerator) Gen() []byte {
 	if f != nil && f.PageFont == "mono" {
 		g.writeString(`</div>`)
 	}
-	return g.f.Bytes()
+	d := g.f.Bytes()
+	if bytes.Contains(d, []byte(tocPlaceholder)) {
+		d = bytes.Replace(d, []byte(tocPlaceholder), []byte(g.tableOfContentsHTML()), -1)
+	}
+	return d
 }
 
 func notionToHTML(page *Page, book *Book) []byte {
@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,7 +15,11 @@ import (
 	"github.com/kjk/u"
 )
 
-const maxOutputFileSize = 1024 * 128 // 128 kB
+const (
+	maxOutputFileSize = 1024 * 128 // 128 kB
+
+	toolchainVersionsFileName = "toolchain_versions.txt"
+)
 
 type cachedOutputFile struct {
 	path string
@@ -71,6 +75,7 @@ func cachedFileNo(path string) int {
 // files are cached_output_${no}.txt
 func reloadCachedOutputFilesMust(b *Book) {
 	b.sha1ToCachedOutputFile = make(map[string]*cachedOutputFile)
+	b.cachedOutputFiles = nil
 
 	fileInfos, err := ioutil.ReadDir(b.OutputCacheDir())
 	u.PanicIfErr(err)
@@ -78,7 +83,7 @@ func reloadCachedOutputFilesMust(b *Book) {
 		if fi.IsDir() {
 			continue
 		}
-		if fi.Name() == "sha1_to_go_playground_id.txt" {
+		if fi.Name() == "sha1_to_go_playground_id.txt" || fi.Name() == toolchainVersionsFileName {
 			continue
 		}
 		if !isCachedOutputFile(fi.Name()) {
@@ -124,8 +129,37 @@ func findOutputBySha1(cof *cachedOutputFile, sha1Hex string) string {
 	return ""
 }
 
-func saveCachedOutputFile(cof *cachedOutputFile) {
-	doc := cof.doc
+// returns cached output for a file with a given key (see outputCacheKey)
+// safe to call from multiple goroutines
+func findCachedOutput(b *Book, sf *SourceFile, key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cacheUsage.outputKeys[key] = true
+	cof := b.sha1ToCachedOutputFile[key]
+	if cof != nil {
+		// is guaranteed to exist
+		return findOutputBySha1(cof, key), true
+	}
+
+	// output cached before the key included runner and directive is under
+	// sha1 of the content. We move it to the current key in the first build
+	// after the change and, since the old key is not used, cache gc removes it
+	if !b.migrateLegacyOutput {
+		return "", false
+	}
+	legacyKey := u.Sha1HexOfBytes(sf.Data)
+	cof = b.sha1ToCachedOutputFile[legacyKey]
+	if cof == nil {
+		return "", false
+	}
+	s := findOutputBySha1(cof, legacyKey)
+	cof.doc = kvstore.ReplaceOrAppend(cof.doc, key, s)
+	b.sha1ToCachedOutputFile[key] = cof
+	return s, true
+}
+
+// sorts the doc by key and returns content of cached_output_${no}.txt
+func serializeCachedOutputDoc(doc kvstore.Doc) []byte {
 	sort.Slice(doc, func(i, j int) bool {
 		k1 := doc[i].Key
 		k2 := doc[j].Key
@@ -136,8 +170,12 @@ func saveCachedOutputFile(cof *cachedOutputFile) {
 		s := kvstore.SerializeLong(kv.Key, kv.Value)
 		recs = append(recs, s)
 	}
-	s := strings.Join(recs, "")
-	err := ioutil.WriteFile(cof.path, []byte(s), 0644)
+	return []byte(strings.Join(recs, ""))
+}
+
+func saveCachedOutputFile(cof *cachedOutputFile) {
+	d := serializeCachedOutputDoc(cof.doc)
+	err := ioutil.WriteFile(cof.path, d, 0644)
 	u.PanicIfErr(err)
 	fmt.Printf("Wrote '%s'\n", cof.path)
 }
@@ -146,18 +184,11 @@ func saveCachedOutputFiles(b *Book) {
 	for _, cof := range b.cachedOutputFiles {
 		saveCachedOutputFile(cof)
 	}
+	saveToolchainVersions(b)
+	b.migrateLegacyOutput = false
 	reloadCachedOutputFilesMust(b)
 }
 
-// runs `go run ${path}` and returns captured output`
-func getGoOutput(path string) (string, error) {
-	dir, fileName := filepath.Split(path)
-	cmd := exec.Command("go", "run", fileName)
-	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
-	return string(out), err
-}
-
 func getRunCmdOutput(path string, runCmd string) (string, error) {
 	parts, err := shlex.Split(runCmd)
 	maybePanicIfErr(err)
@@ -167,7 +198,7 @@ func getRunCmdOutput(path string, runCmd string) (string, error) {
 	exeName := parts[0]
 	parts = parts[1:]
 	var parts2 []string
-	srcDir, srcFileName := filepath.Split(path)
+	srcFileName := filepath.Base(path)
 
 	// remove empty lines and replace variables
 	for _, part := range parts {
@@ -181,11 +212,7 @@ func getRunCmdOutput(path string, runCmd string) (string, error) {
 		parts2 = append(parts2, part)
 	}
 	//fmt.Printf("getRunCmdOutput: running '%s' with args '%#v'\n", exeName, parts2)
-	cmd := exec.Command(exeName, parts2...)
-	cmd.Dir = srcDir
-	out, err := cmd.CombinedOutput()
-	//fmt.Printf("getRunCmdOutput: out:\n%s\n", string(out))
-	return string(out), err
+	return codeRunner.Run(path, exeName, parts2...)
 }
 
 func stripCurrentPathFromOutput(s string) string {
@@ -204,25 +231,136 @@ func getOutput(path string, runCmd string) (string, error) {
 	}
 
 	// do default
-	ext := strings.ToLower(filepath.Ext(path))
-	if ext == ".go" {
-		s, err := getGoOutput(path)
+	runner := findLangRunnerForFile(path)
+	if runner != nil {
+		s, err := runner.Run(path)
 		return stripCurrentPathFromOutput(s), err
 	}
+	ext := strings.ToLower(filepath.Ext(path))
 	return "", fmt.Errorf("getOutput(%s): files with extension '%s' are not supported", path, ext)
 }
 
+// returns name and toolchain version of the runner for a source file
+func getRunnerIdentity(b *Book, sf *SourceFile) (string, string) {
+	var r *LangRunner
+	id := ""
+	if sf.RunCmd != "" {
+		id = "run: " + sf.RunCmd
+		parts, err := shlex.Split(sf.RunCmd)
+		if err == nil && len(parts) > 0 {
+			r = findLangRunnerForExe(parts[0])
+		}
+	} else {
+		r = findLangRunnerForFile(sf.FileName)
+		if r != nil {
+			id = r.Name
+		}
+	}
+	if r == nil {
+		return id, ""
+	}
+	return id, getToolchainVersion(b, r)
+}
+
+// output of running a file depends not only on its content but also on
+// how we run it so the key includes runner, version of its toolchain
+// and parts of file directive that change the output
+func outputCacheKey(b *Book, sf *SourceFile) string {
+	runnerID, version := getRunnerIdentity(b, sf)
+	directive := "allow error: " + strconv.FormatBool(sf.Directive.AllowError)
+	return sha1HexOfStrings(string(sf.Data), runnerID, version, directive)
+}
+
+var reToolchainVersion = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// returns major and minor version e.g. "1.21" for "go version go1.21.3
+// linux/amd64" so that the key doesn't depend on patch version or platform
+func normalizeToolchainVersion(v string) string {
+	m := reToolchainVersion.FindStringSubmatch(v)
+	if m == nil {
+		return strings.TrimSpace(v)
+	}
+	return m[1] + "." + m[2]
+}
+
+// we remember versions of toolchains used to create cached output so that
+// we can find cached output for files whose toolchain is not installed.
+// Cached output without toolchain versions is keyed by sha1 of the content
+// and we migrate it to current keys (see findCachedOutput)
+func loadToolchainVersions(b *Book) {
+	b.toolchainVersions = map[string]string{}
+	path := filepath.Join(b.OutputCacheDir(), toolchainVersionsFileName)
+	if !pathExists(path) {
+		b.migrateLegacyOutput = len(b.cachedOutputFiles) > 0
+		return
+	}
+	doc, err := kvstore.ParseKVFile(path)
+	u.PanicIfErr(err)
+	for _, kv := range doc {
+		b.toolchainVersions[kv.Key] = normalizeToolchainVersion(kv.Value)
+	}
+}
+
+func saveToolchainVersions(b *Book) {
+	var names []string
+	for name := range b.toolchainVersions {
+		names = append(names, name)
+	}
+	// after migration the file must exist even if no toolchain was used
+	if len(names) == 0 && !b.migrateLegacyOutput {
+		return
+	}
+	sort.Strings(names)
+	var recs []string
+	for _, name := range names {
+		recs = append(recs, kvstore.Serialize(name, b.toolchainVersions[name]))
+	}
+	path := filepath.Join(b.OutputCacheDir(), toolchainVersionsFileName)
+	err := ioutil.WriteFile(path, []byte(strings.Join(recs, "")), 0644)
+	u.PanicIfErr(err)
+}
+
+func getToolchainVersion(b *Book, r *LangRunner) string {
+	v := normalizeToolchainVersion(r.Version())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v == "" {
+		return b.toolchainVersions[r.Name]
+	}
+	b.toolchainVersions[r.Name] = v
+	return v
+}
+
+// shouldRecreateOutput returns true if we should ignore cached output for
+// a file at path (or replit url) embedded in a page
+func shouldRecreateOutput(page *Page, path string) bool {
+	if flgRecreateOutput {
+		return true
+	}
+	v := flgRecreateOutputFor
+	if v == "" {
+		return false
+	}
+	id := extractNotionIDFromURL(v)
+	if id == "" && isValidNotionID(normalizeID(v)) {
+		id = normalizeID(v)
+	}
+	if id != "" {
+		return page != nil && page.NotionID == id
+	}
+	return filepath.ToSlash(filepath.Clean(v)) == filepath.ToSlash(filepath.Clean(path))
+}
+
 func getOutputCachedForReplit(b *Book, replit *Replit, sf *SourceFile) error {
 	if sf.Directive.NoOutput {
 		return nil
 	}
 
-	sha1Hex := u.Sha1HexOfBytes(sf.Data)
+	key := outputCacheKey(b, sf)
 
-	cof := b.sha1ToCachedOutputFile[sha1Hex]
-	if cof != nil {
-		// is guaranteed to exist
-		sf.Output = findOutputBySha1(cof, sha1Hex)
+	// when verifying, getOutputCached needs the files to re-run them
+	if s, ok := findCachedOutput(b, sf, key); ok && !sf.recreateOutput && !flgVerifyOutput {
+		sf.Output = s
 		return nil
 	}
 
@@ -255,7 +393,9 @@ func getOutputCachedForReplit(b *Book, replit *Replit, sf *SourceFile) error {
 		}
 	}
 
-	panicIf(sf.Path == "", "no main file")
+	if sf.Path == "" {
+		return fmt.Errorf("no main file in replit '%s'", replit.url)
+	}
 	return getOutputCached(b, sf)
 }
 
@@ -269,12 +409,13 @@ func getOutputCached(b *Book, sf *SourceFile) error {
 		return nil
 	}
 
-	sha1Hex := u.Sha1HexOfBytes(sf.Data)
+	key := outputCacheKey(b, sf)
 
-	cof := b.sha1ToCachedOutputFile[sha1Hex]
-	if cof != nil {
-		// is guaranteed to exist
-		sf.Output = findOutputBySha1(cof, sha1Hex)
+	if s, ok := findCachedOutput(b, sf, key); ok && !sf.recreateOutput {
+		if flgVerifyOutput {
+			verifyCachedOutput(sf, s)
+		}
+		sf.Output = s
 		return nil
 	}
 
@@ -287,19 +428,29 @@ func getOutputCached(b *Book, sf *SourceFile) error {
 
 	// fmt.Printf("loadFileCached('%s') failed with '%s'\n", outputPath, err)
 	s, err := getOutput(path, sf.RunCmd)
+	if err == errRunnerNotAvailable {
+		// not an error, we just can't run it on this machine
+		return nil
+	}
 	if err != nil {
-		if !sf.Directive.AllowError {
+		if !sf.Directive.AllowError || isRunLimitError(err) {
 			fmt.Printf("getOutput('%s'), output is:\n%s\n", path, s)
 			return err
 		}
 		err = nil
 	}
 
-	fmt.Printf("Got output '%s' for '%s'\n", sha1Hex, path)
-	cof = getCurrentOutputCacheFile(b)
-	cof.doc = kvstore.ReplaceOrAppend(cof.doc, sha1Hex, s)
+	fmt.Printf("Got output '%s' for '%s'\n", key, path)
+	b.mu.Lock()
+	// when re-creating, replace the value in the file it's already in
+	cof := b.sha1ToCachedOutputFile[key]
+	if cof == nil {
+		cof = getCurrentOutputCacheFile(b)
+	}
+	cof.doc = kvstore.ReplaceOrAppend(cof.doc, key, s)
+	b.sha1ToCachedOutputFile[key] = cof
+	b.mu.Unlock()
 
-	b.sha1ToCachedOutputFile[sha1Hex] = cof
 	sf.Output = s
 	return nil
 }
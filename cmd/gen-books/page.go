@@ -41,9 +41,15 @@ type Page struct {
 
 	// filled during html generation
 	Headings []HeadingInfo
+	// pages this page links to, filled during html generation
+	linkedPages []*Page
 
-	// TODO: those should come from notion_cache and downloaded during download
-	// step to notion_cache
+	// see page_nav.go
+	prev    *Page
+	next    *Page
+	related []*Page
+
+	// files in www of images in the page, filled during html generation
 	images []string
 }
 
@@ -55,6 +61,49 @@ func (p *Page) Siblings() []*Page {
 	return p.Parent.Pages
 }
 
+// Depth returns 0 for the book's root page, 1 for chapters, 2 for
+// their sub-pages etc.
+func (p *Page) Depth() int {
+	n := 0
+	for p.Parent != nil {
+		n++
+		p = p.Parent
+	}
+	return n
+}
+
+// IndexInParent returns index of the page among its siblings
+func (p *Page) IndexInParent() int {
+	for i, sibling := range p.Siblings() {
+		if sibling == p {
+			return i
+		}
+	}
+	return 0
+}
+
+// Chapter returns top-level page that contains this page
+func (p *Page) Chapter() *Page {
+	for p.Parent != nil && p.Parent.Parent != nil {
+		p = p.Parent
+	}
+	return p
+}
+
+// BreadcrumbPages returns pages shown in breadcrumbs between the book
+// and the parent, starting with the chapter. Empty for pages at depth 2
+// or less
+func (p *Page) BreadcrumbPages() []*Page {
+	var res []*Page
+	if p.Parent == nil {
+		return nil
+	}
+	for curr := p.Parent.Parent; curr != nil && curr.Parent != nil; curr = curr.Parent {
+		res = append([]*Page{curr}, res...)
+	}
+	return res
+}
+
 // Body is a temporary alias for BodyHTML
 func (p *Page) Body() template.HTML {
 	return p.BodyHTML
@@ -111,10 +160,6 @@ func (p *Page) destFilePath() string {
 	return filepath.Join(destEssentialDir, p.Book.Dir, fileName)
 }
 
-func (p *Page) destImagePath(name string) string {
-	return filepath.Join(destEssentialDir, p.Book.Dir, name)
-}
-
 // PageTitle returns title for the page
 // We want this to be unique for SEO purposes
 func (p *Page) PageTitle() string {
@@ -141,17 +186,22 @@ func findSourceFileForEmbedURL(page *Page, uri string) *SourceFile {
 
 // extract sub page information and removes blocks that contain
 // this info
-func getSubPages(page *notionapi.Page, pageIDToPage map[string]*notionapi.Page) []*notionapi.Page {
+func getSubPages(book *Book, p *Page) []*notionapi.Page {
+	page := p.NotionPage
 	var res []*notionapi.Page
 	toRemove := map[int]bool{}
 	for idx, block := range page.Root.Content {
 		if block.Type != notionapi.BlockPage {
 			continue
 		}
-		toRemove[idx] = true
 		id := normalizeID(block.ID)
-		subPage := pageIDToPage[id]
-		panicIf(subPage == nil, "no sub page for id %s", id)
+		subPage := book.pageIDToPage[id]
+		if subPage == nil {
+			// the block stays as a link to a missing page
+			reportPage(SeverityError, book, p, block.ID, "no sub page for id %s", id)
+			continue
+		}
+		toRemove[idx] = true
 		res = append(res, subPage)
 	}
 	removeBlocks(page, toRemove)
@@ -228,7 +278,7 @@ func removeBlocks(page *notionapi.Page, toRemove map[int]bool) {
 
 // extracts PageMeta and updates Block.Content to remove the blocks that
 // contained meta information
-func extractMeta(p *Page) {
+func extractMeta(book *Book, p *Page) {
 	page := p.NotionPage
 	toRemove := map[int]bool{}
 	for idx, block := range page.Root.Content {
@@ -252,7 +302,7 @@ func extractMeta(p *Page) {
 		case "$score":
 			// ignore
 		default:
-			panicIf(true, "unknown key '%s' in page with id %s", mv.Key, normalizeID(page.ID))
+			reportPage(SeverityError, book, p, block.ID, "unknown meta key '%s'", mv.Key)
 		}
 	}
 	removeBlocks(page, toRemove)
@@ -265,15 +315,16 @@ func bookPageFromNotionPage(book *Book, page *notionapi.Page) *Page {
 	res.NotionPage = page
 	res.NotionID = normalizeID(page.ID)
 	res.Title = page.Root.Title
-	extractMeta(res)
+	extractMeta(book, res)
 	extractSourceFiles(book, res)
-	subPages := getSubPages(page, book.pageIDToPage)
+	subPages := getSubPages(book, res)
 
 	// fmt.Printf("bookPageFromNotionPage: %s %s\n", normalizeID(page.ID), res.Meta.ID)
 
 	for _, subPage := range subPages {
 		bookPage := bookPageFromNotionPage(book, subPage)
 		bookPage.Book = book
+		bookPage.Parent = res
 		res.Pages = append(res.Pages, bookPage)
 	}
 	return res
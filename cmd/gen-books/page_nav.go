@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+/*
+Navigation between pages that is computed when generating the book:
+
+- Prev() / Next() follow reading order of the book i.e. chapter, its
+  sub-pages (recursively), next chapter etc.
+- Related() are pages that share $search synonyms or headings with the
+  page or link to / are linked from the page. Parent and sub-pages are
+  not related because they're already shown on the page.
+
+Synonyms and headings used by many pages (e.g. "Introduction") don't
+say much about pages being related so we ignore them.
+*/
+
+const (
+	maxRelatedPages = 5
+	// synonyms and headings shared by more pages are ignored
+	maxPagesWithSharedTerm = 6
+
+	relatedScoreSynonym = 3
+	relatedScoreLink    = 2
+	relatedScoreHeading = 1
+)
+
+// Prev returns previous page in reading order, nil for the first page
+func (p *Page) Prev() *Page {
+	return p.prev
+}
+
+// Next returns next page in reading order, nil for the last page
+func (p *Page) Next() *Page {
+	return p.next
+}
+
+// Related returns pages related to this page, most related first
+func (p *Page) Related() []*Page {
+	return p.related
+}
+
+// returns pages of the book, excluding the root page, in reading order
+func getPagesInReadingOrder(book *Book) []*Page {
+	var res []*Page
+	var add func(*Page)
+	add = func(p *Page) {
+		res = append(res, p)
+		for _, child := range p.Pages {
+			add(child)
+		}
+	}
+	for _, chapter := range book.Chapters() {
+		add(chapter)
+	}
+	return res
+}
+
+func setPrevNext(book *Book) {
+	pages := getPagesInReadingOrder(book)
+	for i, page := range pages {
+		page.prev = nil
+		page.next = nil
+		if i > 0 {
+			page.prev = pages[i-1]
+		}
+		if i < len(pages)-1 {
+			page.next = pages[i+1]
+		}
+	}
+}
+
+func normalizeRelatedTerm(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// maps normalized term to pages that have it. A page is only added once
+func addPageTerm(m map[string][]*Page, term string, page *Page) {
+	term = normalizeRelatedTerm(term)
+	if term == "" {
+		return
+	}
+	pages := m[term]
+	if len(pages) > 0 && pages[len(pages)-1] == page {
+		return
+	}
+	m[term] = append(pages, page)
+}
+
+func addRelatedScores(scores map[*Page]map[*Page]int, termToPages map[string][]*Page, score int) {
+	for _, pages := range termToPages {
+		if len(pages) < 2 || len(pages) > maxPagesWithSharedTerm {
+			continue
+		}
+		for _, p1 := range pages {
+			for _, p2 := range pages {
+				if p1 != p2 {
+					scores[p1][p2] += score
+				}
+			}
+		}
+	}
+}
+
+func isParentOrChild(p1, p2 *Page) bool {
+	return p1.Parent == p2 || p2.Parent == p1
+}
+
+// setRelatedPages must be called after pages were converted to html
+// because that's when we find links between pages
+func setRelatedPages(book *Book) {
+	pages := getPagesInReadingOrder(book)
+	order := map[*Page]int{}
+	scores := map[*Page]map[*Page]int{}
+	synonyms := map[string][]*Page{}
+	headings := map[string][]*Page{}
+	for i, page := range pages {
+		order[page] = i
+		scores[page] = map[*Page]int{}
+		for _, syn := range page.Search {
+			addPageTerm(synonyms, syn, page)
+		}
+		for _, h := range page.Headings {
+			addPageTerm(headings, h.Text, page)
+		}
+	}
+	addRelatedScores(scores, synonyms, relatedScoreSynonym)
+	addRelatedScores(scores, headings, relatedScoreHeading)
+	for _, page := range pages {
+		for _, linked := range page.linkedPages {
+			if _, ok := scores[linked]; !ok || linked == page {
+				continue
+			}
+			scores[page][linked] += relatedScoreLink
+			scores[linked][page] += relatedScoreLink
+		}
+	}
+
+	for _, page := range pages {
+		var related []*Page
+		for other := range scores[page] {
+			if !isParentOrChild(page, other) {
+				related = append(related, other)
+			}
+		}
+		pageScores := scores[page]
+		sort.Slice(related, func(i, j int) bool {
+			p1 := related[i]
+			p2 := related[j]
+			if pageScores[p1] != pageScores[p2] {
+				return pageScores[p1] > pageScores[p2]
+			}
+			return order[p1] < order[p2]
+		})
+		if len(related) > maxRelatedPages {
+			related = related[:maxRelatedPages]
+		}
+		page.related = related
+	}
+}
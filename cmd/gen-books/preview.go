@@ -10,6 +10,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/kjk/notionapi"
 )
 
 func fileExists(path string) bool {
@@ -62,14 +64,40 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		serve404(w, r)
 		return
 	}
+	if isDirectory(path) && fileExists(filepath.Join(path, "index.html")) {
+		path = filepath.Join(path, "index.html")
+	}
+	if strings.HasSuffix(path, ".html") {
+		serveHTMLWithLiveReload(w, r, path)
+		return
+	}
 	http.ServeFile(w, r, path)
 }
 
+// injects live reload script into html pages
+func serveHTMLWithLiveReload(w http.ResponseWriter, r *http.Request, path string) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		serve404(w, r)
+		return
+	}
+	s := string(d)
+	idx := strings.LastIndex(s, "</body>")
+	if idx == -1 {
+		idx = len(s)
+	}
+	s = s[:idx] + liveReloadScript + s[idx:]
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(s))
+}
+
 // https://blog.gopheracademy.com/advent-2016/exposing-go-on-the-internet/
 func makeHTTPServer() *http.Server {
 	mux := &http.ServeMux{}
 
 	mux.HandleFunc("/", handleIndex)
+	mux.HandleFunc(liveReloadURL, handleLiveReload)
 
 	srv := &http.Server{
 		ReadTimeout:  5 * time.Second,
@@ -79,7 +107,7 @@ func makeHTTPServer() *http.Server {
 	}
 	return srv
 }
-func startPreview() {
+func startPreview(client *notionapi.Client) {
 	httpSrv := makeHTTPServer()
 	httpSrv.Addr = "127.0.0.1:8080"
 
@@ -95,6 +123,8 @@ func startPreview() {
 	fmt.Printf("Started listening on %s\n", httpSrv.Addr)
 	openBrowser("http://127.0.0.1:8080")
 
+	go watchAndRebuild(client)
+
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt /* SIGINT */, syscall.SIGTERM)
 	sig := <-c
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kjk/notionapi"
+)
+
+/*
+In preview mode we watch templates, notion cache and source files of the books.
+When they change, we re-build the website and tell the browser to reload
+the page.
+
+Browser is notified via server-sent events. http server has a short
+WriteTimeout so we don't keep the connection open forever. Instead the
+browser re-connects and sends id of the last build it has seen in
+Last-Event-ID header. If a build happened in-between, we tell it to reload.
+*/
+
+const (
+	liveReloadURL = "/__livereload"
+
+	liveReloadScript = `<script>
+(function() {
+	var es = new EventSource("/__livereload");
+	es.onmessage = function(e) {
+		if (e.data === "reload") {
+			window.location.reload();
+		}
+	};
+})();
+</script>
+`
+
+	watchPollInterval = 500 * time.Millisecond
+	// must be less than WriteTimeout of http server
+	liveReloadMaxWait = 4 * time.Second
+)
+
+var (
+	muLiveReload sync.Mutex
+	// incremented on every re-build
+	liveReloadBuildNo int
+	// closed when a re-build finishes
+	liveReloadNotify = make(chan struct{})
+)
+
+func notifyLiveReload() {
+	muLiveReload.Lock()
+	liveReloadBuildNo++
+	close(liveReloadNotify)
+	liveReloadNotify = make(chan struct{})
+	muLiveReload.Unlock()
+}
+
+func writeLiveReloadEvent(w http.ResponseWriter, buildNo int, msg string) {
+	fmt.Fprintf(w, "retry: 1000\nid: %d\ndata: %s\n\n", buildNo, msg)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func handleLiveReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	muLiveReload.Lock()
+	buildNo := liveReloadBuildNo
+	notify := liveReloadNotify
+	muLiveReload.Unlock()
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID != "" {
+		n, err := strconv.Atoi(lastID)
+		if err == nil && n < buildNo {
+			writeLiveReloadEvent(w, buildNo, "reload")
+			return
+		}
+	}
+	writeLiveReloadEvent(w, buildNo, "connected")
+
+	select {
+	case <-notify:
+		muLiveReload.Lock()
+		buildNo = liveReloadBuildNo
+		muLiveReload.Unlock()
+		writeLiveReloadEvent(w, buildNo, "reload")
+	case <-time.After(liveReloadMaxWait):
+	case <-r.Context().Done():
+	}
+}
+
+// fileState is what we use to detect that a file has changed
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func getWatchedDirs() []string {
+	dirs := []string{tmplDir}
+	for _, book := range books {
+		dirs = append(dirs, book.NotionCacheDir(), book.SourceDir())
+	}
+	return dirs
+}
+
+// returns state of all files in dirs, recursively
+func snapshotFiles(dirs []string) map[string]fileState {
+	res := map[string]fileState{}
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+			res[path] = fileState{
+				modTime: fi.ModTime(),
+				size:    fi.Size(),
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+// returns names of files that were added, removed or modified
+func diffSnapshots(prev, curr map[string]fileState) []string {
+	var res []string
+	for path, st := range curr {
+		if prevSt, ok := prev[path]; !ok || prevSt != st {
+			res = append(res, path)
+		}
+	}
+	for path := range prev {
+		if _, ok := curr[path]; !ok {
+			res = append(res, path)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// re-build can fail e.g. because of invalid template. We don't want that
+// to kill the preview so we log the error and wait for the next change
+func rebuildAllSafe(client *notionapi.Client) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Re-build failed with: %v\n", r)
+			// don't start next build while pages of this one are
+			// still being generated
+			for _, b := range books {
+				b.wg.Wait()
+			}
+			printAndClearErrors()
+			ok = false
+		}
+	}()
+	timeStart := time.Now()
+	unloadTemplates()
+	startNextBuildManifest()
+	loadAndGenAllBooks(client)
+	fmt.Printf("Re-build finished in %s\n", time.Since(timeStart))
+	return true
+}
+
+func watchAndRebuild(client *notionapi.Client) {
+	// pages downloaded during first build are now in the cache
+	flgNoCache = false
+	flgRefreshChanged = false
+
+	dirs := getWatchedDirs()
+	fmt.Printf("Watching for changes in %v\n", dirs)
+	prev := snapshotFiles(dirs)
+	for {
+		time.Sleep(watchPollInterval)
+		curr := snapshotFiles(dirs)
+		changed := diffSnapshots(prev, curr)
+		if len(changed) == 0 {
+			continue
+		}
+		// give editors a chance to finish writing the files
+		time.Sleep(watchPollInterval)
+		curr = snapshotFiles(dirs)
+		prev = curr
+		fmt.Printf("Changed files: %v, re-building\n", changed)
+		if rebuildAllSafe(client) {
+			notifyLiveReload()
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setupSandbox makes the program run in its own process group so that we
+// can kill child processes too (`go run` starts the compiled program as
+// a child). If sandbox is true, it also runs in new user and network
+// namespaces and, if prlimit is available, with resource limits.
+func setupSandbox(cmd *exec.Cmd, r *CodeRunner) {
+	attr := &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if r.Sandbox {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+		attr.UidMappings = []syscall.SysProcIDMap{
+			{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1},
+		}
+		attr.GidMappings = []syscall.SysProcIDMap{
+			{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1},
+		}
+		if path, err := exec.LookPath("prlimit"); err == nil {
+			cpuSecs := int(r.Timeout.Seconds()) + 1
+			args := []string{
+				"prlimit",
+				fmt.Sprintf("--cpu=%d", cpuSecs),
+				"--fsize=67108864", // 64 MB
+				"--core=0",
+				"--",
+			}
+			cmd.Args = append(args, cmd.Args...)
+			cmd.Path = path
+		}
+	}
+	cmd.SysProcAttr = attr
+}
+
+// kills the process and all processes in its process group
+func killProcessTree(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	pid := cmd.Process.Pid
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+}
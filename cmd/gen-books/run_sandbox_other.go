@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+var (
+	warnNoSandboxOnce sync.Once
+)
+
+// sandboxing is only implemented on Linux
+func setupSandbox(cmd *exec.Cmd, r *CodeRunner) {
+	if r.Sandbox {
+		warnNoSandboxOnce.Do(func() {
+			fmt.Printf("-run-sandbox is only supported on Linux, running without sandbox\n")
+		})
+	}
+}
+
+// only kills the process. Processes started by it might still be running
+func killProcessTree(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+/*
+Snapshot is a single .zip file with everything in cache/${book} i.e. notion
+pages, replit cache, cached output and go playground ids. It allows
+re-building the website without access to notion.
+
+snapshot.json in the archive describes the snapshot and has sha1 of every
+file. We verify all files before importing anything.
+*/
+
+const (
+	snapshotVersion      = 1
+	snapshotManifestName = "snapshot.json"
+)
+
+// SnapshotBook describes a book in a snapshot
+type SnapshotBook struct {
+	Dir               string
+	Title             string
+	NotionStartPageID string
+}
+
+// SnapshotFile describes a file in a snapshot
+type SnapshotFile struct {
+	// path relative to current directory, with '/' separator
+	Path string
+	Sha1 string
+	Size int64
+}
+
+// Snapshot describes content of a snapshot archive
+type Snapshot struct {
+	Version   int
+	CreatedOn time.Time
+	Books     []*SnapshotBook
+	Files     []*SnapshotFile
+}
+
+// returns paths of all files in dir, recursively, sorted
+func getFilesRecur(dir string) ([]string, error) {
+	var res []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			res = append(res, path)
+		}
+		return nil
+	})
+	sort.Strings(res)
+	return res, err
+}
+
+func exportSnapshotMust(zipPath string) {
+	snapshot := &Snapshot{
+		Version:   snapshotVersion,
+		CreatedOn: time.Now().UTC(),
+	}
+
+	f, err := os.Create(zipPath)
+	panicIfErr(err)
+	zw := zip.NewWriter(f)
+	for _, b := range books {
+		snapshot.Books = append(snapshot.Books, &SnapshotBook{
+			Dir:               b.Dir,
+			Title:             b.Title,
+			NotionStartPageID: b.NotionStartPageID,
+		})
+		paths, err := getFilesRecur(b.CacheDir())
+		panicIfErr(err)
+		for _, path := range paths {
+			d, err := ioutil.ReadFile(path)
+			panicIfErr(err)
+			name := filepath.ToSlash(path)
+			w, err := zw.Create(name)
+			panicIfErr(err)
+			_, err = w.Write(d)
+			panicIfErr(err)
+			snapshot.Files = append(snapshot.Files, &SnapshotFile{
+				Path: name,
+				Sha1: u.Sha1HexOfBytes(d),
+				Size: int64(len(d)),
+			})
+		}
+	}
+
+	d, err := json.MarshalIndent(snapshot, "", "  ")
+	panicIfErr(err)
+	w, err := zw.Create(snapshotManifestName)
+	panicIfErr(err)
+	_, err = w.Write(d)
+	panicIfErr(err)
+	err = zw.Close()
+	panicIfErr(err)
+	err = f.Close()
+	panicIfErr(err)
+	fmt.Printf("Exported %d files of %d books to '%s'\n", len(snapshot.Files), len(snapshot.Books), zipPath)
+}
+
+// we only allow files inside cache/${book} of books in the snapshot
+func isValidSnapshotPath(name string, snapshot *Snapshot) bool {
+	if name != filepath.ToSlash(filepath.Clean(filepath.FromSlash(name))) || filepath.IsAbs(name) {
+		return false
+	}
+	for _, sb := range snapshot.Books {
+		if strings.HasPrefix(name, "cache/"+sb.Dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func readSnapshot(zr *zip.Reader) (*Snapshot, map[string][]byte, error) {
+	files := map[string][]byte{}
+	var snapshot *Snapshot
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		d, err := unzipFileAsData(zf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if zf.Name == snapshotManifestName {
+			snapshot = &Snapshot{}
+			err = json.Unmarshal(d, snapshot)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %s", snapshotManifestName, err)
+			}
+			continue
+		}
+		files[zf.Name] = d
+	}
+	if snapshot == nil {
+		return nil, nil, fmt.Errorf("%s is missing", snapshotManifestName)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version %d, we support %d", snapshot.Version, snapshotVersion)
+	}
+	for _, sb := range snapshot.Books {
+		if findBookFromDir(sb.Dir) == nil {
+			return nil, nil, fmt.Errorf("unknown book '%s'", sb.Dir)
+		}
+	}
+	if len(files) != len(snapshot.Files) {
+		return nil, nil, fmt.Errorf("snapshot has %d files, expected %d", len(files), len(snapshot.Files))
+	}
+	for _, sf := range snapshot.Files {
+		if !isValidSnapshotPath(sf.Path, snapshot) {
+			return nil, nil, fmt.Errorf("invalid path '%s'", sf.Path)
+		}
+		d, ok := files[sf.Path]
+		if !ok {
+			return nil, nil, fmt.Errorf("file '%s' is missing", sf.Path)
+		}
+		if int64(len(d)) != sf.Size || u.Sha1HexOfBytes(d) != sf.Sha1 {
+			return nil, nil, fmt.Errorf("file '%s' is corrupted", sf.Path)
+		}
+	}
+	return snapshot, files, nil
+}
+
+// importSnapshotMust replaces cache of books in the snapshot with its content
+func importSnapshotMust(zipPath string) {
+	zrc, err := zip.OpenReader(zipPath)
+	panicIfErr(err)
+	defer zrc.Close()
+	snapshot, files, err := readSnapshot(&zrc.Reader)
+	if err != nil {
+		fmt.Printf("'%s' is not a valid snapshot: %s\n", zipPath, err)
+		os.Exit(1)
+	}
+
+	for _, sb := range snapshot.Books {
+		b := findBookFromDir(sb.Dir)
+		if b.NotionStartPageID != sb.NotionStartPageID {
+			fmt.Printf("Warning: book '%s' in snapshot starts at notion page %s, we start at %s\n", sb.Dir, sb.NotionStartPageID, b.NotionStartPageID)
+		}
+		err = os.RemoveAll(b.CacheDir())
+		panicIfErr(err)
+	}
+	for _, sf := range snapshot.Files {
+		dst := filepath.FromSlash(sf.Path)
+		createDirForFileMaybeMust(dst)
+		err = ioutil.WriteFile(dst, files[sf.Path], 0644)
+		panicIfErr(err)
+	}
+	fmt.Printf("Imported %d files of %d books from '%s' created on %s\n", len(snapshot.Files), len(snapshot.Books), zipPath, snapshot.CreatedOn.Format("2006-01-02 15:04"))
+}
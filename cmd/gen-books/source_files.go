@@ -119,6 +119,11 @@ type SourceFile struct {
 
 	// output of running a file
 	Output string
+
+	// if true, ignore cached output and run the file again
+	recreateOutput bool
+	// page in which the file is embedded
+	page *Page
 }
 
 // DataFiltered returns content of the file after filtering
@@ -225,7 +230,7 @@ func setSourceFileData(sf *SourceFile, data []byte) error {
 	return err
 }
 
-func loadSourceFile(b *Book, path string) (*SourceFile, error) {
+func loadSourceFile(b *Book, page *Page, path string) (*SourceFile, error) {
 	data, err := common.ReadFileNormalized(path)
 	if err != nil {
 		return nil, err
@@ -242,16 +247,18 @@ func loadSourceFile(b *Book, path string) (*SourceFile, error) {
 
 	err = setSourceFileData(sf, data)
 	if err != nil {
-		fmt.Printf("loadSourceFile: '%s', setSourceFileData() failed with '%s'\n", path, err)
-		panicIfErr(err)
+		return nil, err
 	}
 	if sf.Directive.NoOutput {
 		fmt.Printf("NoOutput for '%s'\n", path)
 	}
 	setGoPlaygroundID(b, sf)
+	sf.page = page
+	sf.recreateOutput = shouldRecreateOutput(page, path)
 	err = getOutputCached(b, sf)
 	fmt.Printf("loadSourceFile: '%s', lang: '%s'\n", path, lang)
-	return sf, nil
+	// returning sf because failing to get output is not fatal
+	return sf, err
 }
 
 // TODO: remove when all code moved to repl.it
@@ -269,16 +276,20 @@ func extractSourceFiles(b *Book, p *Page) {
 		}
 		relativePath := gitoembedToRelativePath(uri)
 		if relativePath == "" {
-			fmt.Printf("Couldn't parse embed uri '%s'\n", uri)
+			reportPage(SeverityError, b, p, block.ID, "couldn't parse embed uri '%s'", uri)
 			continue
 		}
 		// fmt.Printf("Embed uri: %s, relativePath: %s\n", uri, relativePath)
 		//path := filepath.Join(wd, relativePath)
 		path := relativePath
-		sf, err := loadSourceFile(b, path)
+		sf, err := loadSourceFile(b, p, path)
+		if sf != nil && err != nil {
+			reportRunError(b, p, block.ID, err)
+			err = nil
+		}
 		if err != nil {
-			fmt.Printf("extractSourceFiles: loadSourceFile('%s') (uri: '%s') failed with '%s'\n", path, uri, err)
-			panicIfErr(err)
+			reportPage(SeverityError, b, p, block.ID, "loading source file '%s' (uri: '%s') failed with '%s'", path, uri, err)
+			continue
 		}
 		sf.EmbedURL = uri
 		p.SourceFiles = append(p.SourceFiles, sf)
@@ -92,32 +92,47 @@ func testGetGoPlaygroundShareIDAndExit() {
 	os.Exit(0)
 }
 
-// GetPlaygroundID gets go playground id from content
-func (c *Sha1ToGoPlaygroundCache) GetPlaygroundID(d []byte) (string, error) {
+// Add remembers go playground id for content with a given sha1
+// Not thread-safe, caller must hold b.mu
+func (c *Sha1ToGoPlaygroundCache) Add(sha1 string, id string) error {
+	s := fmt.Sprintf("%s %s\n", sha1, id)
+	err := appendToFile(c.cachePath, s)
+	if err != nil {
+		return err
+	}
+	c.sha1ToID[sha1] = id
+	c.nUpdates++
+	return nil
+}
+
+// safe to call from multiple goroutines. We don't hold b.mu while talking
+// to go playground so that we don't block generating other pages
+func getSha1ToGoPlaygroundIDCached(b *Book, d []byte) (string, error) {
+	c := b.sha1ToGoPlaygroundCache
 	sha1 := u.Sha1HexOfBytes(d)
+	b.mu.Lock()
+	b.cacheUsage.playgroundSha1s[sha1] = true
 	id, ok := c.sha1ToID[sha1]
+	b.mu.Unlock()
 	if ok {
 		return id, nil
 	}
+
 	id, err := getGoPlaygroundShareID(d)
 	if err != nil {
 		return "", err
 	}
-	s := fmt.Sprintf("%s %s\n", sha1, id)
-	err = appendToFile(c.cachePath, s)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// another page with the same code might have done it in the meantime
+	if prevID, ok := c.sha1ToID[sha1]; ok {
+		return prevID, nil
+	}
+	err = c.Add(sha1, id)
 	if err != nil {
 		return "", err
 	}
-	c.nUpdates++
+	fmt.Printf("getSha1ToGoPlaygroundIDCached: %s => %s\n", sha1, id)
 	return id, nil
 }
-
-func getSha1ToGoPlaygroundIDCached(b *Book, d []byte) (string, error) {
-	nUpdates := b.sha1ToGoPlaygroundCache.nUpdates
-	id, err := b.sha1ToGoPlaygroundCache.GetPlaygroundID(d)
-	if err == nil && nUpdates != b.sha1ToGoPlaygroundCache.nUpdates {
-		sha1 := u.Sha1HexOfBytes(d)
-		fmt.Printf("getSha1ToGoPlaygroundIDCached: %s => %s\n", sha1, id)
-	}
-	return id, err
-}
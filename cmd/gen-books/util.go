@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/kjk/u"
 )
@@ -111,36 +112,52 @@ func urlify(title string) string {
 
 var (
 	softErrorMode bool
-	errors        []string
+	// protects totalHTMLBytes and totalHTMLBytesMinified
+	muErrors sync.Mutex
 
 	totalHTMLBytes         int
 	totalHTMLBytesMinified int
 )
 
+// in soft error mode errors are recorded and the build continues
 func maybePanicIfErr(err error) {
+	maybePanicIfErrPage(nil, nil, err)
+}
+
+// maybePanicIfErrPage is like maybePanicIfErr but records the error as a
+// problem in the page. b and page can be nil
+func maybePanicIfErrPage(b *Book, page *Page, err error) {
 	if err == nil {
 		return
 	}
 	if !softErrorMode {
 		panicIfErr(err)
 	}
-	errors = append(errors, err.Error())
+	reportPage(SeverityError, b, page, "", "%s", err)
 }
 
-func clearErrors() {
-	errors = nil
-	totalHTMLBytes = 0
-	totalHTMLBytesMinified = 0
+// records an error to be shown at the end of the build
+func addError(err error) {
+	addDiagnostic(&Diagnostic{
+		Severity: SeverityError,
+		Message:  err.Error(),
+	})
+}
+
+func addMinifiedHTMLBytes(n, nMinified int) {
+	muErrors.Lock()
+	totalHTMLBytes += n
+	totalHTMLBytesMinified += nMinified
+	muErrors.Unlock()
 }
 
 func printAndClearErrors() {
+	muErrors.Lock()
 	fmt.Printf("HTML: optimized %d => %d (saved %d bytes)\n", totalHTMLBytes, totalHTMLBytesMinified, totalHTMLBytes-totalHTMLBytesMinified)
-	if len(errors) == 0 {
-		return
-	}
-	errStr := strings.Join(errors, "\n")
-	fmt.Printf("\n%d errors:\n%s\n\n", len(errors), errStr)
-	clearErrors()
+	totalHTMLBytes = 0
+	totalHTMLBytesMinified = 0
+	muErrors.Unlock()
+	finishDiagnostics()
 }
 
 func createDirForFileMaybeMust(path string) {
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+With -verify-output we re-execute source files that have cached output and
+compare the new output with what is in the cache. This catches examples that
+broke e.g. with a new Go release. Cached output is not updated.
+*/
+
+const (
+	diffContextLines = 3
+	// max number of cells in the table used to diff outputs
+	maxDiffTableSize = 1024 * 1024
+)
+
+// OutputMismatch describes a source file whose output is different
+// than cached output
+type OutputMismatch struct {
+	// path of the file or url of a replit
+	Name         string
+	PageTitle    string
+	PageNotionID string
+	Diff         string
+	// non-nil if running the file failed
+	Err error
+}
+
+var (
+	muOutputMismatches sync.Mutex
+	outputMismatches   []*OutputMismatch
+
+	// files from replits are run from directories like /tmp/src123456/
+	rxTempSrcDir = regexp.MustCompile(`[^\s:'"]*[/\\]src[0-9]+[/\\]`)
+)
+
+// output contains paths of temporary directories which are different
+// on every run
+func normalizeOutputForCompare(s string) string {
+	s = stripCurrentPathFromOutput(s)
+	return rxTempSrcDir.ReplaceAllString(s, "")
+}
+
+// re-runs a source file with cached output and records the differences
+func verifyCachedOutput(sf *SourceFile, cached string) {
+	s, err := getOutput(sf.Path, sf.RunCmd)
+	if err == errRunnerNotAvailable {
+		return
+	}
+	if err != nil && sf.Directive.AllowError && !isRunLimitError(err) {
+		err = nil
+	}
+	expected := normalizeOutputForCompare(cached)
+	got := normalizeOutputForCompare(s)
+	if err == nil && expected == got {
+		return
+	}
+	name := sf.Path
+	if sf.EmbedURL != "" {
+		name = sf.EmbedURL
+	}
+	m := &OutputMismatch{
+		Name: name,
+		Diff: unifiedDiff(expected, got, "cached", "current"),
+		Err:  err,
+	}
+	if sf.page != nil {
+		m.PageTitle = sf.page.Title
+		m.PageNotionID = sf.page.NotionID
+	}
+	muOutputMismatches.Lock()
+	outputMismatches = append(outputMismatches, m)
+	muOutputMismatches.Unlock()
+}
+
+// printOutputMismatches prints differences found by -verify-output and
+// returns their number
+func printOutputMismatches() int {
+	muOutputMismatches.Lock()
+	defer muOutputMismatches.Unlock()
+	sort.Slice(outputMismatches, func(i, j int) bool {
+		return outputMismatches[i].Name < outputMismatches[j].Name
+	})
+	for _, m := range outputMismatches {
+		fmt.Printf("\nOutput of '%s' changed", m.Name)
+		if m.PageNotionID != "" {
+			fmt.Printf(" in page '%s' %s%s", m.PageTitle, notionBaseURL, m.PageNotionID)
+		}
+		fmt.Printf("\n")
+		if m.Err != nil {
+			fmt.Printf("error: %s\n", m.Err)
+		}
+		fmt.Printf("%s", m.Diff)
+	}
+	n := len(outputMismatches)
+	fmt.Printf("verify-output: %d files with changed output\n", n)
+	outputMismatches = nil
+	return n
+}
+
+// lines include "\n" so that a missing newline at the end is a difference
+func splitOutputLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff returns a diff of a and b in unified format or empty string
+// if they are the same
+func unifiedDiff(a, b string, nameA, nameB string) string {
+	if a == b {
+		return ""
+	}
+	linesA := splitOutputLines(a)
+	linesB := splitOutputLines(b)
+
+	// usually only a few lines change so we only diff lines between
+	// common prefix and suffix
+	nPrefix := 0
+	for nPrefix < len(linesA) && nPrefix < len(linesB) && linesA[nPrefix] == linesB[nPrefix] {
+		nPrefix++
+	}
+	nSuffix := 0
+	for nSuffix < len(linesA)-nPrefix && nSuffix < len(linesB)-nPrefix &&
+		linesA[len(linesA)-1-nSuffix] == linesB[len(linesB)-1-nSuffix] {
+		nSuffix++
+	}
+	midA := linesA[nPrefix : len(linesA)-nSuffix]
+	midB := linesB[nPrefix : len(linesB)-nSuffix]
+	nA := len(midA)
+	nB := len(midB)
+
+	// lcs[i][j] is length of longest common subsequence of
+	// midA[i:] and midB[j:]. If the table would be too big, we show
+	// all lines as changed
+	var lcs [][]int
+	if nA*nB <= maxDiffTableSize {
+		lcs = make([][]int, nA+1)
+		for i := range lcs {
+			lcs[i] = make([]int, nB+1)
+		}
+		for i := nA - 1; i >= 0; i-- {
+			for j := nB - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+	}
+
+	// kind is ' ', '-' or '+'
+	type diffOp struct {
+		kind byte
+		line string
+		// line numbers (0-based) in a and b before this op
+		i, j int
+	}
+	var ops []diffOp
+	for k := 0; k < nPrefix; k++ {
+		ops = append(ops, diffOp{' ', linesA[k], k, k})
+	}
+	i, j := 0, 0
+	for i < nA || j < nB {
+		switch {
+		case lcs != nil && i < nA && j < nB && midA[i] == midB[j]:
+			ops = append(ops, diffOp{' ', midA[i], nPrefix + i, nPrefix + j})
+			i++
+			j++
+		case i < nA && (j == nB || lcs == nil || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', midA[i], nPrefix + i, nPrefix + j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', midB[j], nPrefix + i, nPrefix + j})
+			j++
+		}
+	}
+	for k := 0; k < nSuffix; k++ {
+		ops = append(ops, diffOp{' ', linesA[nPrefix+nA+k], nPrefix + nA + k, nPrefix + nB + k})
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	n := len(ops)
+	for start := 0; start < n; {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// extend the hunk until there are more than 2*diffContextLines
+		// unchanged lines
+		end := start
+		for k := start; k < n; k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContextLines {
+				break
+			}
+		}
+		hunkStart := start - diffContextLines
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := end + diffContextLines
+		if hunkEnd > n {
+			hunkEnd = n
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		// empty range starts at the line before it
+		lineA, lineB := ops[hunkStart].i+1, ops[hunkStart].j+1
+		if countA == 0 {
+			lineA--
+		}
+		if countB == 0 {
+			lineB--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, op := range ops[hunkStart:hunkEnd] {
+			fmt.Fprintf(&sb, "%c%s\n", op.kind, strings.TrimSuffix(op.line, "\n"))
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\\ No newline at end of file\n")
+			}
+		}
+		start = hunkEnd
+	}
+	return sb.String()
+}
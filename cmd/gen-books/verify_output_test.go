@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  string
+	}{
+		{"", "", ""},
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb", "a\nb", ""},
+		// insert
+		{"a\nc\n", "a\nb\nc\n", "@@ -1,2 +1,3 @@\n a\n+b\n c\n"},
+		{"", "a\n", "@@ -0,0 +1,1 @@\n+a\n"},
+		// delete
+		{"a\nb\nc\n", "a\nc\n", "@@ -1,3 +1,2 @@\n a\n-b\n c\n"},
+		{"a\n", "", "@@ -1,1 +0,0 @@\n-a\n"},
+		// change at the end
+		{"a\nb\nc\n", "a\nb\nd\n", "@@ -1,3 +1,3 @@\n a\n b\n-c\n+d\n"},
+		{"a\nb\nc", "a\nb\nd", "@@ -1,3 +1,3 @@\n a\n b\n-c\n\\ No newline at end of file\n+d\n\\ No newline at end of file\n"},
+		// only trailing newline is different
+		{"a\nb\n", "a\nb", "@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n"},
+		{"a\nb", "a\nb\n", "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		// lines far from changes are not shown
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\n5\n6\n7\n8\nx\n", "@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+x\n"},
+		{"x\n2\n3\n4\n5\n6\n7\n8\n9\n10\ny\n", "X\n2\n3\n4\n5\n6\n7\n8\n9\n10\nY\n", "@@ -1,4 +1,4 @@\n-x\n+X\n 2\n 3\n 4\n@@ -8,4 +8,4 @@\n 8\n 9\n 10\n-y\n+Y\n"},
+	}
+	for _, test := range tests {
+		got := unifiedDiff(test.a, test.b, "a", "b")
+		exp := test.exp
+		if exp != "" {
+			exp = "--- a\n+++ b\n" + exp
+		}
+		if got != exp {
+			t.Errorf("unifiedDiff(%q, %q) is:\n%s\nexpected:\n%s", test.a, test.b, got, exp)
+		}
+	}
+}
+
+func TestUnifiedDiffLargeOutput(t *testing.T) {
+	// each line is different so the diff table would be too big
+	var a, b []string
+	for i := 0; i < 2000; i++ {
+		a = append(a, fmt.Sprintf("a%d", i))
+		b = append(b, fmt.Sprintf("b%d", i))
+	}
+	got := unifiedDiff(strings.Join(a, "\n"), strings.Join(b, "\n"), "a", "b")
+	if !strings.HasPrefix(got, "--- a\n+++ b\n@@ -1,2000 +1,2000 @@\n-a0\n") {
+		t.Errorf("unexpected diff:\n%s", got[:100])
+	}
+	if n := strings.Count(got, "\n-"); n != 2000 {
+		t.Errorf("got %d removed lines, expected 2000", n)
+	}
+}
@@ -253,7 +253,7 @@ func SerializeDoc(doc Doc) (string, error) {
 			return "", fmt.Errorf("key: '%s' value '%s' contains \\n", kv.Key, v)
 		}
 		if len(v) > 256 {
-			return "", fmt.Errorf("key: '%s', value is %d bytes (> 256)", kv.Key, v)
+			return "", fmt.Errorf("key: '%s', value is %d bytes (> 256)", kv.Key, len(v))
 		}
 		s := fmt.Sprintf("%s: %s", kv.Key, v)
 		lines = append(lines, s)
@@ -0,0 +1,138 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+Index is an inverted index: for each term we have a list of documents
+that contain it, with a weight. The weight is a sum of occurrences of
+the term, each multiplied by the weight of the field it was in.
+
+For the website the index is saved as:
+- index.json : Meta i.e. list of documents and names of shards
+- ${shard}.json : postings of terms that start with ${shard} (see ShardKey)
+
+The client loads index.json and then only the shards needed for terms
+in the query.
+*/
+
+// IndexVersion is a version of the format of saved index
+const IndexVersion = 1
+
+// Field is a part of a document. Words in more important fields have
+// higher weight
+type Field int
+
+const (
+	// FieldCode is source code
+	FieldCode Field = iota
+	// FieldBody is text of a document
+	FieldBody
+	// FieldHeading is a heading inside a document
+	FieldHeading
+	// FieldTitle is a title of a document (or its search synonym)
+	FieldTitle
+)
+
+var fieldWeights = []int{1, 2, 4, 8}
+
+// Doc is a document in the index
+type Doc struct {
+	URL   string
+	Title string
+}
+
+// Index is an inverted index of documents
+type Index struct {
+	Docs []*Doc
+	// maps term to a flat list of (doc index, weight) pairs, sorted by
+	// doc index
+	Postings map[string][]int
+}
+
+// Meta describes saved index
+type Meta struct {
+	Version int
+	// [url, title] for each document
+	Docs   [][]string
+	Shards []string
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		Postings: map[string][]int{},
+	}
+}
+
+// AddDoc adds a document and returns its index
+func (idx *Index) AddDoc(url, title string) int {
+	idx.Docs = append(idx.Docs, &Doc{
+		URL:   url,
+		Title: title,
+	})
+	return len(idx.Docs) - 1
+}
+
+// AddText indexes text s as a field of a document. Text can only be
+// added to the most recently added document
+func (idx *Index) AddText(docIdx int, s string, field Field) {
+	if docIdx != len(idx.Docs)-1 {
+		panic(fmt.Sprintf("AddText: doc %d is not the last doc", docIdx))
+	}
+	weight := fieldWeights[field]
+	for _, term := range Terms(s) {
+		a := idx.Postings[term]
+		n := len(a)
+		if n > 0 && a[n-2] == docIdx {
+			a[n-1] += weight
+			continue
+		}
+		idx.Postings[term] = append(a, docIdx, weight)
+	}
+}
+
+// ShardKey returns name of the shard that has a term. It's the first
+// character of the term for a-z and 0-9 and "_" for everything else
+func ShardKey(term string) string {
+	if term == "" {
+		return "_"
+	}
+	c := term[0]
+	if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+		return string(c)
+	}
+	return "_"
+}
+
+// Shards splits postings into shards, keyed by ShardKey
+func (idx *Index) Shards() map[string]map[string][]int {
+	res := map[string]map[string][]int{}
+	for term, postings := range idx.Postings {
+		key := ShardKey(term)
+		shard := res[key]
+		if shard == nil {
+			shard = map[string][]int{}
+			res[key] = shard
+		}
+		shard[term] = postings
+	}
+	return res
+}
+
+// Meta returns description of the index, saved as index.json
+func (idx *Index) Meta() *Meta {
+	res := &Meta{
+		Version: IndexVersion,
+	}
+	for _, doc := range idx.Docs {
+		res.Docs = append(res.Docs, []string{doc.URL, doc.Title})
+	}
+	for key := range idx.Shards() {
+		res.Shards = append(res.Shards, key)
+	}
+	sort.Strings(res.Shards)
+	return res
+}
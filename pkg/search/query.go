@@ -0,0 +1,119 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+/*
+Query defines ranking that client-side search must reproduce:
+
+- the query is split into terms like indexed text (see Terms)
+- a document must match all terms
+- the last term also matches indexed terms that start with it, so that
+  results show up while the user is typing
+- for each query term, a document scores the best of its matching terms:
+  idf(term) * (1 + ln(weight)), where idf(term) = ln(1 + N/df), N is number
+  of documents and df is number of documents with the term
+- score of a document is a sum of scores for each query term
+- results are sorted by score, highest first. Documents with the same
+  score are in index order (which is the order of the book)
+*/
+
+// Result is a document matching a query
+type Result struct {
+	DocIdx int
+	Doc    *Doc
+	Score  float64
+}
+
+func (idx *Index) idf(term string) float64 {
+	df := len(idx.Postings[term]) / 2
+	if df == 0 {
+		return 0
+	}
+	return math.Log(1 + float64(len(idx.Docs))/float64(df))
+}
+
+// returns indexed terms matching query term
+func (idx *Index) matchingTerms(term string, isPrefix bool) []string {
+	if !isPrefix {
+		if _, ok := idx.Postings[term]; ok {
+			return []string{term}
+		}
+		return nil
+	}
+	var res []string
+	for t := range idx.Postings {
+		if strings.HasPrefix(t, term) {
+			res = append(res, t)
+		}
+	}
+	// so that the result doesn't depend on map iteration order
+	sort.Strings(res)
+	return res
+}
+
+// returns score of each document for a query term
+func (idx *Index) termScores(term string, isPrefix bool) map[int]float64 {
+	res := map[int]float64{}
+	for _, t := range idx.matchingTerms(term, isPrefix) {
+		idf := idx.idf(t)
+		postings := idx.Postings[t]
+		for i := 0; i+1 < len(postings); i += 2 {
+			docIdx := postings[i]
+			weight := postings[i+1]
+			score := idf * (1 + math.Log(float64(weight)))
+			if score > res[docIdx] {
+				res[docIdx] = score
+			}
+		}
+	}
+	return res
+}
+
+// Query returns up to max documents matching q, best first. max <= 0
+// means no limit
+func (idx *Index) Query(q string, max int) []*Result {
+	terms := Terms(q)
+	if len(terms) == 0 {
+		return nil
+	}
+	var scores map[int]float64
+	for i, term := range terms {
+		isLast := i == len(terms)-1
+		termScores := idx.termScores(term, isLast)
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for docIdx, score := range scores {
+			termScore, ok := termScores[docIdx]
+			if !ok {
+				delete(scores, docIdx)
+				continue
+			}
+			scores[docIdx] = score + termScore
+		}
+	}
+
+	var res []*Result
+	for docIdx, score := range scores {
+		res = append(res, &Result{
+			DocIdx: docIdx,
+			Doc:    idx.Docs[docIdx],
+			Score:  score,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].DocIdx < res[j].DocIdx
+	})
+	if max > 0 && len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
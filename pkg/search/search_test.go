@@ -0,0 +1,165 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word string
+		exp  string
+	}{
+		{"go", "go"},
+		{"map", "map"},
+		{"maps", "map"},
+		{"goroutine", "goroutin"},
+		{"goroutines", "goroutin"},
+		{"running", "run"},
+		{"mapped", "map"},
+		{"testing", "test"},
+		{"string", "string"},
+		{"need", "need"},
+		{"create", "creat"},
+		{"created", "creat"},
+		{"creates", "creat"},
+		{"libraries", "library"},
+		{"classes", "class"},
+		{"class", "class"},
+		{"status", "status"},
+		{"quickly", "quick"},
+		{"falling", "fall"},
+		{"go1", "go1"},
+		{"héllos", "héllos"},
+	}
+	for _, test := range tests {
+		got := Stem(test.word)
+		if got != test.exp {
+			t.Errorf("Stem(%q) = %q, expected %q", test.word, got, test.exp)
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp []string
+	}{
+		{"", nil},
+		{"The Go Programming Language", []string{"go", "program", "languag"}},
+		{"fmt.Println(\"Hello, World\")", []string{"fmt", "println", "hello", "world"}},
+		{"a b if x", nil},
+		{"map[string]int", []string{"map", "string", "int"}},
+	}
+	for _, test := range tests {
+		got := Terms(test.s)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Terms(%q) = %#v, expected %#v", test.s, got, test.exp)
+		}
+	}
+}
+
+func buildTestIndex() *Index {
+	idx := NewIndex()
+	docs := []struct {
+		title string
+		body  string
+		code  string
+	}{
+		{"Maps", "A map is an unordered collection of key-value pairs.", "m := map[string]int{}"},
+		{"Goroutines", "Goroutines run concurrently. Use channels to communicate.", "go func() {}()"},
+		{"Channels", "Channels connect goroutines.", "ch := make(chan int)"},
+		{"Strings", "Strings are immutable. Iterating over a string gives runes.", "s := \"hello\""},
+		{"Sorting", "Sort a slice of strings or a map by keys.", "sort.Strings(a)"},
+	}
+	for i, d := range docs {
+		docIdx := idx.AddDoc("/doc"+string('0'+rune(i)), d.title)
+		idx.AddText(docIdx, d.title, FieldTitle)
+		idx.AddText(docIdx, d.body, FieldBody)
+		idx.AddText(docIdx, d.code, FieldCode)
+	}
+	return idx
+}
+
+func queryTitles(idx *Index, q string, max int) []string {
+	var res []string
+	for _, r := range idx.Query(q, max) {
+		res = append(res, r.Doc.Title)
+	}
+	return res
+}
+
+func TestQuery(t *testing.T) {
+	idx := buildTestIndex()
+	tests := []struct {
+		q   string
+		exp []string
+	}{
+		// stop words only
+		{"the", nil},
+		{"nothing", nil},
+		{"println", nil},
+		// title match ranks higher than body match
+		{"map", []string{"Maps", "Sorting"}},
+		{"goroutines", []string{"Goroutines", "Channels"}},
+		// all terms must match
+		{"map keys", []string{"Maps", "Sorting"}},
+		{"map slice", []string{"Sorting"}},
+		// last term is a prefix
+		{"chan", []string{"Channels", "Goroutines"}},
+		{"str", []string{"Strings", "Sorting", "Maps"}},
+		// stemming
+		{"iterate", []string{"Strings"}},
+		// code is indexed
+		{"make", []string{"Channels"}},
+	}
+	for _, test := range tests {
+		got := queryTitles(idx, test.q, 0)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Query(%q) = %#v, expected %#v", test.q, got, test.exp)
+		}
+	}
+
+	got := queryTitles(idx, "str", 1)
+	if !reflect.DeepEqual(got, []string{"Strings"}) {
+		t.Errorf("Query(%q, 1) = %#v", "str", got)
+	}
+}
+
+func TestQueryTiesInIndexOrder(t *testing.T) {
+	idx := NewIndex()
+	for _, title := range []string{"b", "a", "c"} {
+		docIdx := idx.AddDoc(title, title)
+		idx.AddText(docIdx, "same text", FieldBody)
+	}
+	res := idx.Query("same text", 0)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	for i, r := range res {
+		if r.DocIdx != i {
+			t.Errorf("result %d is doc %d", i, r.DocIdx)
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	idx := buildTestIndex()
+	shards := idx.Shards()
+	n := 0
+	for key, shard := range shards {
+		for term := range shard {
+			if ShardKey(term) != key {
+				t.Errorf("term %q in shard %q", term, key)
+			}
+			n++
+		}
+	}
+	if n != len(idx.Postings) {
+		t.Errorf("shards have %d terms, expected %d", n, len(idx.Postings))
+	}
+	meta := idx.Meta()
+	if len(meta.Docs) != len(idx.Docs) || len(meta.Shards) != len(shards) {
+		t.Errorf("unexpected meta %#v", meta)
+	}
+}
@@ -0,0 +1,159 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+Text is split into terms the same way when building the index and when
+searching:
+- a word is a maximal run of letters and digits, lower-cased
+- words shorter than minWordLen or longer than maxWordLen are skipped
+- stop words are skipped
+- remaining words are stemmed with Stem
+
+The stemmer is deliberately simple (a handful of suffix rules) so that
+client-side javascript can reproduce it exactly.
+*/
+
+const (
+	minWordLen = 2
+	maxWordLen = 32
+)
+
+var stopWords = map[string]bool{}
+
+func init() {
+	words := `a about above after again all also am an and any are as at
+be because been before being below between both but by can could did do
+does doing down during each few for from further had has have having he
+her here hers him his how i if in into is it its itself just me more most
+my no nor not now of off on once only or other our ours out over own same
+she should so some such than that the their theirs them then there these
+they this those through to too under until up very was we were what when
+where which while who whom why will with would you your yours`
+	for _, w := range strings.Fields(words) {
+		stopWords[w] = true
+	}
+}
+
+// IsStopWord returns true if a lower-cased word is too common to be indexed
+func IsStopWord(w string) bool {
+	return stopWords[w]
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Words splits s into lower-cased words, without any filtering
+func Words(s string) []string {
+	f := func(r rune) bool {
+		return !isWordRune(r)
+	}
+	return strings.FieldsFunc(strings.ToLower(s), f)
+}
+
+// Terms splits s into terms that are indexed and searched
+func Terms(s string) []string {
+	var res []string
+	for _, w := range Words(s) {
+		if t := wordToTerm(w); t != "" {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// returns empty string if a word should not be indexed
+func wordToTerm(w string) string {
+	n := len([]rune(w))
+	if n < minWordLen || n > maxWordLen || IsStopWord(w) {
+		return ""
+	}
+	return Stem(w)
+}
+
+func isVowel(c byte) bool {
+	switch c {
+	case 'a', 'e', 'i', 'o', 'u':
+		return true
+	}
+	return false
+}
+
+func hasVowel(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if isVowel(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCIILowerWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// "runn" => "run", but "fall" stays "fall"
+func undouble(s string) string {
+	n := len(s)
+	if n < 2 || s[n-1] != s[n-2] || isVowel(s[n-1]) {
+		return s
+	}
+	switch s[n-1] {
+	case 'l', 's', 'z':
+		return s
+	}
+	return s[:n-1]
+}
+
+// Stem reduces a lower-cased word to its stem e.g. "goroutines" and
+// "goroutine" both become "goroutin". Only words made of ASCII letters
+// longer than 3 characters are stemmed.
+func Stem(w string) string {
+	if len(w) <= 3 || !isASCIILowerWord(w) {
+		return w
+	}
+
+	// plurals
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		w = w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "ss"), strings.HasSuffix(w, "us"), strings.HasSuffix(w, "is"):
+		// "class", "status", "analysis"
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+
+	// stem must be at least 3 characters and have a vowel so that e.g.
+	// "string" and "need" are not stemmed
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if !strings.HasSuffix(w, suffix) {
+			continue
+		}
+		stem := w[:len(w)-len(suffix)]
+		if len(stem) >= 3 && hasVowel(stem) {
+			w = stem
+			if suffix != "ly" {
+				w = undouble(w)
+			}
+		}
+		break
+	}
+
+	// "create", "created" and "creates" are all "creat"
+	if strings.HasSuffix(w, "e") && len(w) > 4 {
+		w = w[:len(w)-1]
+	}
+	return w
+}
@@ -717,7 +717,33 @@ function setTocExpandedForCurrentURL() {
   }
 }
 
+// toggles are <details> elements. If url points to an element inside
+// toggles, we open them so that it's visible
+function openTogglesForLocationHash() {
+  var id = window.location.hash.substr(1);
+  if (id === "") {
+    return;
+  }
+  var el = document.getElementById(decodeURIComponent(id));
+  if (!el) {
+    return;
+  }
+  var opened = false;
+  var parent = el.parentElement;
+  while (parent) {
+    if (parent.tagName === "DETAILS" && !parent.open) {
+      parent.open = true;
+      opened = true;
+    }
+    parent = parent.parentElement;
+  }
+  if (opened) {
+    el.scrollIntoView();
+  }
+}
+
 function locationHashChanged(e) {
+  openTogglesForLocationHash();
   tocUnexpandAll();
   setTocExpandedForCurrentURL();
   recreateTOC();
@@ -1158,6 +1184,7 @@ function start() {
   }
   // if this is chapter or article, we generate toc
   window.onhashchange = locationHashChanged;
+  openTogglesForLocationHash();
   tocUnexpandAll();
   setTocExpandedForCurrentURL();
   var tocItemElementID = createTOC();